@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/sqlc-dev/plugin-sdk-go/codegen"
 	"github.com/sqlc-dev/plugin-sdk-go/plugin"
@@ -15,10 +16,46 @@ type Options struct {
 	Module                    string `json:"module"`
 	EmitJSONTags              bool   `json:"emit_json_tags"`
 	EmitDBTags                bool   `json:"emit_db_tags"`
-	EmitResultStructPointers  bool   `json:"emit_result_struct_pointers"`
+	EmitResultStructPointers  bool   `json:"emit_result_struct_pointers"` // same as emit_classes
+	EmitClasses               bool   `json:"emit_classes"`
+	EmitProperties            bool   `json:"emit_properties"`
 	GenerateConnectionManager bool   `json:"generate_connection_manager"`
 	GenerateRepositories      bool   `json:"generate_repositories"`
 	EmitBooleanQuestionGetters bool   `json:"emit_boolean_question_getters"`
+	QueryParameterLimit       *int32 `json:"query_parameter_limit"`
+	EmitKeywordParams         bool   `json:"emit_keyword_params"`
+	EmitUnsetNargs            bool   `json:"emit_unset_nargs"`
+	EmptySlices               string `json:"empty_slices"`
+	BucketSliceSizes          bool   `json:"bucket_slice_sizes"`
+	EmitPreparedQueries       bool   `json:"emit_prepared_queries"`
+	EmitInterface             bool   `json:"emit_interface"`
+	EmitMockQueries           bool   `json:"emit_mock_queries"`
+	EmitMethodsWithDBArgument bool   `json:"emit_methods_with_db_argument"`
+	SplitQueriesByFile        bool   `json:"split_queries_by_file"`
+	QueryClassPerFile         bool   `json:"query_class_per_file"`
+	SplitModelsByFile         bool   `json:"split_models_by_file"`
+	OutputModelsFileName      string `json:"output_models_file_name"`
+	OutputQueriesFileName     string `json:"output_queries_file_name"`
+	OutputDatabaseFileName    string `json:"output_database_file_name"`
+	ReservedNameStrategy      string `json:"reserved_name_strategy"`
+	Rename                    map[string]string `json:"rename"`
+	EmitExactTableNames       bool   `json:"emit_exact_table_names"`
+	Inflections               Inflections `json:"inflections"`
+}
+
+// Inflections are project rules for singularizing table names, checked
+// before the built-in ones
+type Inflections struct {
+	Uncountable []string          `json:"uncountable"`
+	Irregular   map[string]string `json:"irregular"`
+	Singular    []InflectionRule  `json:"singular"`
+}
+
+// InflectionRule replaces a regular expression matching the end of a
+// plural table name
+type InflectionRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
 }
 
 // Run is the main entry point for the plugin
@@ -41,6 +78,104 @@ func generate(ctx context.Context, req *plugin.GenerateRequest) (*plugin.Generat
 		moduleName = "Db"
 	}
 	
+	if options.QueryParameterLimit != nil && *options.QueryParameterLimit < 0 {
+		return nil, fmt.Errorf("invalid options: query_parameter_limit must be 0 or greater")
+	}
+
+	switch options.EmptySlices {
+	case "":
+		options.EmptySlices = crystal.EmptySlicesRaise
+	case crystal.EmptySlicesRaise, crystal.EmptySlicesShortCircuit, crystal.EmptySlicesFalsePredicate:
+	default:
+		return nil, fmt.Errorf("invalid options: unknown empty_slices value %q", options.EmptySlices)
+	}
+
+	// The generated files require each other by relative path, so they all
+	// have to live in the output directory itself
+	for opt, name := range map[string]string{
+		"output_models_file_name":   options.OutputModelsFileName,
+		"output_queries_file_name":  options.OutputQueriesFileName,
+		"output_database_file_name": options.OutputDatabaseFileName,
+	} {
+		if name != "" && (!strings.HasSuffix(name, ".cr") || strings.Contains(name, "/")) {
+			return nil, fmt.Errorf("invalid options: %s must be a .cr file name without a directory", opt)
+		}
+	}
+
+	// Each file needs a name of its own, and mock_queries.cr is always
+	// named the same
+	taken := map[string]string{"mock_queries.cr": "the mock queries"}
+	for _, output := range []struct{ opt, name, fallback string }{
+		{"output_models_file_name", options.OutputModelsFileName, "models.cr"},
+		{"output_queries_file_name", options.OutputQueriesFileName, "queries.cr"},
+		{"output_database_file_name", options.OutputDatabaseFileName, "database.cr"},
+	} {
+		name := output.name
+		if name == "" {
+			name = output.fallback
+		}
+		if other, ok := taken[name]; ok {
+			return nil, fmt.Errorf("invalid options: %s %q is already used by %s", output.opt, name, other)
+		}
+		taken[name] = output.opt
+	}
+
+	switch options.ReservedNameStrategy {
+	case "":
+		options.ReservedNameStrategy = crystal.ReservedNameSuffix
+	case crystal.ReservedNameSuffix, crystal.ReservedNamePrefix, crystal.ReservedNameKeep:
+	default:
+		return nil, fmt.Errorf("invalid options: unknown reserved_name_strategy value %q", options.ReservedNameStrategy)
+	}
+
+	if err := crystal.CheckRename(options.Rename); err != nil {
+		return nil, fmt.Errorf("invalid options: rename: %w", err)
+	}
+
+	inflector := crystal.NewInflector()
+	for _, word := range options.Inflections.Uncountable {
+		inflector.AddUncountable(word)
+	}
+	for plural, singular := range options.Inflections.Irregular {
+		inflector.AddIrregular(plural, singular)
+	}
+	// Rules listed first take precedence, so they are added last
+	for i := len(options.Inflections.Singular) - 1; i >= 0; i-- {
+		rule := options.Inflections.Singular[i]
+		if err := inflector.AddRule(rule.Pattern, rule.Replacement); err != nil {
+			return nil, fmt.Errorf("invalid options: inflections: bad singular pattern %q: %w", rule.Pattern, err)
+		}
+	}
+
+	if options.EmitUnsetNargs && req.GetSettings().GetEngine() != "postgresql" {
+		return nil, fmt.Errorf("invalid options: emit_unset_nargs is only supported on postgresql")
+	}
+
+	if options.EmitMockQueries && !options.EmitInterface {
+		return nil, fmt.Errorf("invalid options: emit_mock_queries requires emit_interface")
+	}
+
+	// Both of these keep state on a Queries instance, which this mode has none of
+	if options.EmitMethodsWithDBArgument && options.EmitPreparedQueries {
+		return nil, fmt.Errorf("invalid options: emit_methods_with_db_argument cannot be used with emit_prepared_queries")
+	}
+	if options.EmitMethodsWithDBArgument && options.EmitInterface {
+		return nil, fmt.Errorf("invalid options: emit_methods_with_db_argument cannot be used with emit_interface")
+	}
+
+	// Without a single Queries class there is nothing for an interface or
+	// the repositories to wrap
+	if options.QueryClassPerFile {
+		switch {
+		case !options.SplitQueriesByFile:
+			return nil, fmt.Errorf("invalid options: query_class_per_file requires split_queries_by_file")
+		case options.EmitInterface:
+			return nil, fmt.Errorf("invalid options: query_class_per_file cannot be used with emit_interface")
+		case options.GenerateRepositories:
+			return nil, fmt.Errorf("invalid options: query_class_per_file cannot be used with generate_repositories")
+		}
+	}
+
 	if !options.EmitJSONTags && !options.EmitDBTags {
 		options.EmitDBTags = true // Default to emitting DB tags
 	}
@@ -49,10 +184,30 @@ func generate(ctx context.Context, req *plugin.GenerateRequest) (*plugin.Generat
 	gen := crystal.NewGenerator(req, moduleName, crystal.GeneratorOptions{
 		EmitJSONTags:              options.EmitJSONTags,
 		EmitDBTags:                options.EmitDBTags,
-		EmitResultStructPointers:  options.EmitResultStructPointers,
+		EmitClasses:               options.EmitClasses || options.EmitResultStructPointers,
+		EmitProperties:            options.EmitProperties,
 		GenerateConnectionManager: options.GenerateConnectionManager,
 		GenerateRepositories:      options.GenerateRepositories,
 		EmitBooleanQuestionGetters: options.EmitBooleanQuestionGetters,
+		QueryParameterLimit:       options.QueryParameterLimit,
+		EmitKeywordParams:         options.EmitKeywordParams,
+		EmitUnsetNargs:            options.EmitUnsetNargs,
+		EmptySlices:               options.EmptySlices,
+		BucketSliceSizes:          options.BucketSliceSizes,
+		EmitPreparedQueries:       options.EmitPreparedQueries,
+		EmitInterface:             options.EmitInterface,
+		EmitMockQueries:           options.EmitMockQueries,
+		EmitMethodsWithDBArgument: options.EmitMethodsWithDBArgument,
+		SplitQueriesByFile:        options.SplitQueriesByFile,
+		QueryClassPerFile:         options.QueryClassPerFile,
+		SplitModelsByFile:         options.SplitModelsByFile,
+		ModelsFileName:            options.OutputModelsFileName,
+		QueriesFileName:           options.OutputQueriesFileName,
+		DatabaseFileName:          options.OutputDatabaseFileName,
+		ReservedNameStrategy:      options.ReservedNameStrategy,
+		Rename:                    options.Rename,
+		EmitExactTableNames:       options.EmitExactTableNames,
+		Inflector:                 inflector,
 	})
 	
 	// Generate the code
@@ -0,0 +1,87 @@
+package crystal
+
+import (
+	"strings"
+
+	"github.com/sqlc-dev/plugin-sdk-go/plugin"
+)
+
+// commentLines splits a COMMENT ON string into the lines of a Crystal doc
+// comment, dropping blank lines at either end
+func commentLines(comment string) []string {
+	lines := strings.Split(strings.ReplaceAll(comment, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// moduleDoc collects the comments of the user schemas, which document the
+// module the models live in
+func (g *Generator) moduleDoc() []string {
+	if g.req.Catalog == nil {
+		return nil
+	}
+
+	var doc []string
+	for _, schema := range g.req.Catalog.Schemas {
+		if schema.Name == "information_schema" || schema.Name == "pg_catalog" {
+			continue
+		}
+		lines := commentLines(schema.Comment)
+		if len(lines) == 0 {
+			continue
+		}
+		if len(doc) > 0 {
+			doc = append(doc, "")
+		}
+		doc = append(doc, lines...)
+	}
+	return doc
+}
+
+// columnDoc documents a getter with the column's comment. Enum columns are
+// read as strings, so the comment of their enum type is added as well.
+func (g *Generator) columnDoc(col *plugin.Column) []string {
+	doc := commentLines(col.Comment)
+
+	if enum := g.findEnum(col.Type); enum != nil {
+		if lines := commentLines(enum.Comment); len(lines) > 0 {
+			if len(doc) > 0 {
+				doc = append(doc, "")
+			}
+			lines[0] = "`" + enum.Name + "`: " + lines[0]
+			doc = append(doc, lines...)
+		}
+	}
+	return doc
+}
+
+// findEnum looks up the catalog enum a column type refers to, if any
+func (g *Generator) findEnum(typ *plugin.Identifier) *plugin.Enum {
+	if typ == nil || g.req.Catalog == nil {
+		return nil
+	}
+
+	schemaName := typ.Schema
+	if schemaName == "" {
+		schemaName = g.req.Catalog.DefaultSchema
+	}
+	for _, schema := range g.req.Catalog.Schemas {
+		if schemaName != "" && schema.Name != schemaName {
+			continue
+		}
+		for _, enum := range schema.Enums {
+			if enum.Name == typ.Name {
+				return enum
+			}
+		}
+	}
+	return nil
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"path"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -15,12 +18,47 @@ import (
 type GeneratorOptions struct {
 	EmitJSONTags              bool
 	EmitDBTags                bool
-	EmitResultStructPointers  bool
+	EmitClasses               bool // classes with reference semantics instead of structs
+	EmitProperties            bool // property instead of getter
 	GenerateConnectionManager bool
 	GenerateRepositories      bool
 	EmitBooleanQuestionGetters bool
+	QueryParameterLimit       *int32
+	EmitKeywordParams         bool
+	EmitUnsetNargs            bool
+	EmptySlices               string
+	BucketSliceSizes          bool
+	EmitPreparedQueries       bool
+	EmitInterface             bool
+	EmitMockQueries           bool
+	EmitMethodsWithDBArgument bool
+	SplitQueriesByFile        bool
+	QueryClassPerFile         bool
+	SplitModelsByFile         bool
+	ReservedNameStrategy      string
+	Rename                    map[string]string
+	EmitExactTableNames       bool
+	Inflector                 *Inflector // singularizes table names, NewInflector() if nil
+	ModelsFileName            string
+	QueriesFileName           string
+	DatabaseFileName          string
 }
 
+// Behaviors for empty sqlc.slice() arguments on engines that expand them
+const (
+	EmptySlicesRaise          = "raise"
+	EmptySlicesShortCircuit   = "short_circuit"
+	EmptySlicesFalsePredicate = "false_predicate"
+)
+
+// Strategies for field and parameter names that are Crystal keywords or
+// clash with built-in methods
+const (
+	ReservedNameSuffix = "suffix"
+	ReservedNamePrefix = "prefix"
+	ReservedNameKeep   = "keep"
+)
+
 // Generator generates Crystal code from SQL queries
 type Generator struct {
 	req                *plugin.GenerateRequest
@@ -31,6 +69,19 @@ type Generator struct {
 
 // NewGenerator creates a new Crystal code generator
 func NewGenerator(req *plugin.GenerateRequest, pkg string, options GeneratorOptions) *Generator {
+	if options.ModelsFileName == "" {
+		options.ModelsFileName = "models.cr"
+	}
+	if options.QueriesFileName == "" {
+		options.QueriesFileName = "queries.cr"
+	}
+	if options.DatabaseFileName == "" {
+		options.DatabaseFileName = "database.cr"
+	}
+	if options.Inflector == nil {
+		options.Inflector = defaultInflector
+	}
+
 	return &Generator{
 		req:               req,
 		pkg:               pkg,
@@ -44,29 +95,50 @@ func (g *Generator) Generate(ctx context.Context) (*plugin.GenerateResponse, err
 	var resp plugin.GenerateResponse
 
 	// Generate models if there are any tables
+	modelRequires := []string{requirePath(g.options.ModelsFileName)}
 	if g.req.Catalog != nil && len(g.req.Catalog.Schemas) > 0 {
-		modelsFile, err := g.generateModels()
+		modelFiles, err := g.generateModels()
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate models: %w", err)
 		}
-		if modelsFile != nil {
-			resp.Files = append(resp.Files, modelsFile)
+		if len(modelFiles) > 0 {
+			resp.Files = append(resp.Files, modelFiles...)
+			modelRequires = nil
+			for _, file := range modelFiles {
+				modelRequires = append(modelRequires, requirePath(file.Name))
+			}
 		}
 	}
 
 	// Generate queries if there are any
+	queryRequires := []string{requirePath(g.options.QueriesFileName)}
 	if len(g.req.Queries) > 0 {
-		queriesFile, err := g.generateQueries()
+		queryRequires = nil
+		queries, err := g.buildQueries()
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate queries: %w", err)
 		}
-		if queriesFile != nil {
-			resp.Files = append(resp.Files, queriesFile)
+		queryFiles, err := g.generateQueries(queries)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate queries: %w", err)
+		}
+		resp.Files = append(resp.Files, queryFiles...)
+		for _, file := range queryFiles {
+			queryRequires = append(queryRequires, requirePath(file.Name))
+		}
+
+		// The mock is only required from specs, so database.cr leaves it out
+		if g.options.EmitMockQueries {
+			mockFile, err := g.generateMockQueries(queries)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate mock queries: %w", err)
+			}
+			resp.Files = append(resp.Files, mockFile)
 		}
 	}
 
 	// Always generate database.cr as the entry point file
-	databaseFile, err := g.generateDatabase()
+	databaseFile, err := g.generateDatabase(append(modelRequires, queryRequires...))
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate database: %w", err)
 	}
@@ -83,11 +155,22 @@ func (g *Generator) Generate(ctx context.Context) (*plugin.GenerateResponse, err
 		resp.Files = append(resp.Files, repoFiles...)
 	}
 
+	// Split models and queries write to directories named after their
+	// files, which could still overlap with each other
+	written := make(map[string]bool)
+	for _, file := range resp.Files {
+		if written[file.Name] {
+			return nil, fmt.Errorf("more than one file would be written to %s; set different output file names", file.Name)
+		}
+		written[file.Name] = true
+	}
+
 	return &resp, nil
 }
 
-// generateModels generates the models.cr file
-func (g *Generator) generateModels() (*plugin.File, error) {
+// generateModels generates the models file, or one file per model under a
+// directory named after it
+func (g *Generator) generateModels() ([]*plugin.File, error) {
 	// Collect all unique structs, prioritizing table-based structs over query-specific ones
 	structs := make(map[string]*crystalStruct)
 	// Track field signatures to detect duplicates
@@ -109,19 +192,22 @@ func (g *Generator) generateModels() (*plugin.File, error) {
 				continue
 			}
 
-			structName := toPascalCase(singularize(table.Rel.Name))
+			structName := g.tableStructName(table.Rel.Name)
 
 			cs := &crystalStruct{
 				Name:      structName,
 				TableName: table.Rel.Name,
+				Doc:       commentLines(table.Comment),
 			}
 
-			var fieldSig strings.Builder
 			for _, col := range table.Columns {
+				name, renamed := g.fieldName(table.Rel.Name, col.Name)
 				field := crystalField{
-					Name:   toSnakeCase(col.Name),
-					DBName: col.Name,
-					Type:   g.crystalType(col),
+					Name:    name,
+					DBName:  col.Name,
+					Type:    g.crystalType(col),
+					Doc:     g.columnDoc(col),
+					Renamed: renamed,
 				}
 
 				if g.options.EmitJSONTags {
@@ -129,14 +215,17 @@ func (g *Generator) generateModels() (*plugin.File, error) {
 				}
 
 				cs.Fields = append(cs.Fields, field)
-				// Build field signature for deduplication
-				fieldSig.WriteString(fmt.Sprintf("%s:%s;", field.Name, field.Type))
+			}
+			if err := g.resolveFieldCollisions(cs.Fields); err != nil {
+				return nil, fmt.Errorf("table %s: %w", table.Rel.Name, err)
 			}
 
 			if len(cs.Fields) > 0 {
+				// Build field signature for deduplication
+				signature := fieldSignature(cs.Fields)
 				structs[structName] = cs
-				fieldSignatures[fieldSig.String()] = structName
-				g.signatureToStruct[fieldSig.String()] = structName
+				fieldSignatures[signature] = structName
+				g.signatureToStruct[signature] = structName
 			}
 		}
 	}
@@ -182,7 +271,6 @@ func (g *Generator) generateModels() (*plugin.File, error) {
 		
 		
 		// Build struct fields
-		var fieldSig strings.Builder
 		var fields []crystalField
 		
 		if usesEmbeds {
@@ -191,24 +279,7 @@ func (g *Generator) generateModels() (*plugin.File, error) {
 				// For embed columns, the column itself has the embed info
 				if len(cols) > 0 && cols[0].EmbedTable != nil {
 					// Find the table struct name
-					var structName string
-					if g.req.Catalog != nil {
-						for _, schema := range g.req.Catalog.Schemas {
-							for _, table := range schema.Tables {
-								if table.Rel.Name == tableName {
-									structName = toPascalCase(singularize(table.Rel.Name))
-									break
-								}
-							}
-							if structName != "" {
-								break
-							}
-						}
-					}
-					
-					if structName == "" {
-						structName = toPascalCase(singularize(tableName))
-					}
+					structName := g.tableStructName(tableName)
 					
 					// For embedded tables in LEFT/RIGHT JOINs, check nullability from SQL
 					nullable := strings.Contains(strings.ToUpper(query.Text), "LEFT JOIN") ||
@@ -227,50 +298,64 @@ func (g *Generator) generateModels() (*plugin.File, error) {
 						}
 					}
 					
+					name, renamed := escapeName(toSnakeCase(structName), g.options.ReservedNameStrategy)
 					field := crystalField{
-						Name:   toSnakeCase(singularize(tableName)),
-						DBName: toSnakeCase(singularize(tableName)), // Set DBName to avoid empty key
-						Type:   fieldType,
+						Name:    name,
+						DBName:  toSnakeCase(structName), // Set DBName to avoid empty key
+						Type:    fieldType,
+						Renamed: renamed,
 					}
 					fields = append(fields, field)
-					fieldSig.WriteString(fmt.Sprintf("%s:%s;", field.Name, field.Type))
 				}
 			}
 			
 			// Add standalone columns (like COUNT, etc)
 			for _, col := range standaloneColumns {
+				name, renamed := g.fieldName(columnTable(col), col.Name)
 				field := crystalField{
-					Name:   toSnakeCase(col.Name),
-					DBName: col.Name,
-					Type:   g.crystalType(col),
+					Name:    name,
+					DBName:  col.Name,
+					Type:    g.crystalType(col),
+					Doc:     g.columnDoc(col),
+					Renamed: renamed,
 				}
 
+				if col.Table != nil {
+					field.table = col.Table.Name
+				}
 				if g.options.EmitJSONTags {
 					field.JSONName = col.Name
 				}
 
 				fields = append(fields, field)
-				fieldSig.WriteString(fmt.Sprintf("%s:%s;", field.Name, field.Type))
 			}
 		} else {
 			// Regular query - create normal fields
 			for _, col := range query.Columns {
+				name, renamed := g.fieldName(columnTable(col), col.Name)
 				field := crystalField{
-					Name:   toSnakeCase(col.Name),
-					DBName: col.Name,
-					Type:   g.crystalType(col),
+					Name:    name,
+					DBName:  col.Name,
+					Type:    g.crystalType(col),
+					Doc:     g.columnDoc(col),
+					Renamed: renamed,
 				}
 
+				if col.Table != nil {
+					field.table = col.Table.Name
+				}
 				if g.options.EmitJSONTags {
 					field.JSONName = col.Name
 				}
 
 				fields = append(fields, field)
-				fieldSig.WriteString(fmt.Sprintf("%s:%s;", field.Name, field.Type))
 			}
 		}
 
-		signature := fieldSig.String()
+		if err := g.resolveFieldCollisions(fields); err != nil {
+			return nil, fmt.Errorf("query %s: %w", query.Name, err)
+		}
+		signature := fieldSignature(fields)
 
 		// Check if we already have a struct with this exact field signature
 		if _, exists := fieldSignatures[signature]; exists {
@@ -307,46 +392,182 @@ func (g *Generator) generateModels() (*plugin.File, error) {
 		return structList[i].Name < structList[j].Name
 	})
 
-	// Generate the models file
-	var buf bytes.Buffer
-	err := modelsTemplate.Execute(&buf, templateData{
-		Package:                   g.pkg,
-		Structs:                   structList,
-		EmitJSONTags:              g.options.EmitJSONTags,
-		EmitDBTags:                g.options.EmitDBTags,
-		EmitBooleanQuestionGetters: g.options.EmitBooleanQuestionGetters,
-	})
-	if err != nil {
-		return nil, err
+	// Generate the models file, or one file per model
+	render := func(name string, structs []*crystalStruct, moduleDoc []string) (*plugin.File, error) {
+		var buf bytes.Buffer
+		err := modelsTemplate.Execute(&buf, templateData{
+			Package:                   g.pkg,
+			ModuleDoc:                 moduleDoc,
+			Structs:                   structs,
+			EmitJSONTags:              g.options.EmitJSONTags,
+			EmitDBTags:                g.options.EmitDBTags,
+			EmitBooleanQuestionGetters: g.options.EmitBooleanQuestionGetters,
+			EmitClasses:               g.options.EmitClasses,
+			EmitProperties:            g.options.EmitProperties,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &plugin.File{
+			Name:     name,
+			Contents: buf.Bytes(),
+		}, nil
 	}
 
-	return &plugin.File{
-		Name:     "models.cr",
-		Contents: buf.Bytes(),
-	}, nil
+	if !g.options.SplitModelsByFile {
+		file, err := render(g.options.ModelsFileName, structList, g.moduleDoc())
+		if err != nil {
+			return nil, err
+		}
+		return []*plugin.File{file}, nil
+	}
+
+	// The module is documented once, in the first file that opens it
+	var files []*plugin.File
+	dir := strings.TrimSuffix(g.options.ModelsFileName, ".cr")
+	moduleDoc := g.moduleDoc()
+	for i, s := range structList {
+		if i > 0 {
+			moduleDoc = nil
+		}
+		file, err := render(dir+"/"+toSnakeCase(s.Name)+".cr", []*crystalStruct{s}, moduleDoc)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// fieldName converts a column name to the name of its getter, escaping
+// keywords and built-in method names unless the column is renamed. Columns
+// are renamed by table.column, so columns that don't come from a table
+// keep their name.
+func (g *Generator) fieldName(table, column string) (string, bool) {
+	if name, ok := g.options.Rename[table+"."+column]; ok && table != "" {
+		return name, name != column
+	}
+	return escapeName(toSnakeCase(column), g.options.ReservedNameStrategy)
+}
+
+// columnTable returns the name of the table a column comes from, if any
+func columnTable(col *plugin.Column) string {
+	if col.Table == nil {
+		return ""
+	}
+	return col.Table.Name
+}
+
+// tableStructName is the name of the model struct for a table: the
+// singularized table name unless it is renamed or exact names are used
+func (g *Generator) tableStructName(table string) string {
+	if name, ok := g.options.Rename[table]; ok {
+		return name
+	}
+	if g.options.EmitExactTableNames {
+		return toPascalCase(table)
+	}
+	return toPascalCase(g.options.Inflector.Singularize(table))
+}
+
+// fieldSignature identifies a set of fields for struct deduplication
+func fieldSignature(fields []crystalField) string {
+	var sig strings.Builder
+	for _, field := range fields {
+		sig.WriteString(fmt.Sprintf("%s:%s;", field.Name, field.Type))
+	}
+	return sig.String()
+}
+
+// resolveFieldCollisions renames fields whose names collide after case
+// conversion, such as userId and user_id. The field named exactly after
+// its column keeps the name; the others are prefixed with their table when
+// the columns come from different tables, or numbered otherwise. Rows are
+// read by column name, so columns with the same name can't be told apart
+// and are an error.
+func (g *Generator) resolveFieldCollisions(fields []crystalField) error {
+	columns := make(map[string]bool)
+	taken := make(map[string]bool)
+	groups := make(map[string][]int)
+	var names []string
+	for i, field := range fields {
+		if columns[field.DBName] {
+			return fmt.Errorf("more than one column is named %q, and rows are read by column name; alias all but one of them in the SQL (like `books.id AS book_id`)", field.DBName)
+		}
+		columns[field.DBName] = true
+
+		if !taken[field.Name] {
+			names = append(names, field.Name)
+		}
+		taken[field.Name] = true
+		groups[field.Name] = append(groups[field.Name], i)
+	}
+
+	for _, name := range names {
+		group := groups[name]
+		if len(group) < 2 {
+			continue
+		}
+
+		keep := group[0]
+		tables := make(map[string]bool)
+		for _, i := range group {
+			if fields[i].DBName == name && fields[keep].DBName != name {
+				keep = i
+			}
+			if fields[i].table != "" {
+				tables[fields[i].table] = true
+			}
+		}
+		prefixed := len(tables) == len(group)
+
+		for _, i := range group {
+			if i == keep {
+				continue
+			}
+			candidate := ""
+			if prefixed {
+				candidate = toSnakeCase(g.tableStructName(fields[i].table)) + "_" + name
+			}
+			for n := 2; candidate == "" || taken[candidate]; n++ {
+				candidate = fmt.Sprintf("%s_%d", name, n)
+			}
+			fields[i].Name = candidate
+			fields[i].Renamed = true
+			taken[candidate] = true
+		}
+	}
+	return nil
 }
 
 // getStructNameForQuery determines the appropriate struct name for a query based on field matching
-func (g *Generator) getStructNameForQuery(query *plugin.Query) string {
+func (g *Generator) getStructNameForQuery(query *plugin.Query) (string, error) {
 	if len(query.Columns) <= 1 {
-		return "" // Single column queries don't need structs
+		return "", nil // Single column queries don't need structs
 	}
 
 	// Build field signature for this query
-	var fieldSig strings.Builder
+	var fields []crystalField
 	for _, col := range query.Columns {
+		name, _ := g.fieldName(columnTable(col), col.Name)
 		field := crystalField{
-			Name:   toSnakeCase(col.Name),
+			Name:   name,
 			DBName: col.Name,
 			Type:   g.crystalType(col),
 		}
-		fieldSig.WriteString(fmt.Sprintf("%s:%s;", field.Name, field.Type))
+		if col.Table != nil {
+			field.table = col.Table.Name
+		}
+		fields = append(fields, field)
 	}
-	signature := fieldSig.String()
+	if err := g.resolveFieldCollisions(fields); err != nil {
+		return "", err
+	}
+	signature := fieldSignature(fields)
 
 	// Check if we have a struct with this signature from the deduplication process
 	if structName, exists := g.signatureToStruct[signature]; exists {
-		return structName
+		return structName, nil
 	}
 
 	// Fallback: generate query-specific name (shouldn't happen if models were generated first)
@@ -354,11 +575,11 @@ func (g *Generator) getStructNameForQuery(query *plugin.Query) string {
 	if query.Cmd == ":one" || query.Cmd == ":many" {
 		structName = structName + "Row"
 	}
-	return structName
+	return structName, nil
 }
 
-// generateQueries generates the queries.cr file
-func (g *Generator) generateQueries() (*plugin.File, error) {
+// buildQueries converts the request queries into the form the templates use
+func (g *Generator) buildQueries() ([]crystalQuery, error) {
 	var queries []crystalQuery
 
 	for _, query := range g.req.Queries {
@@ -369,68 +590,81 @@ func (g *Generator) generateQueries() (*plugin.File, error) {
 			Cmd:          query.Cmd,
 			Comments:     query.Comments,
 			ConstantName: toConstantCase(query.Name),
+			SourceFile:   sourceFileName(query.Filename),
+			sourcePath:   query.Filename,
 		}
 
-		// Build parameter list
-		hasSlice := false
-		for _, param := range query.Params {
-			p := crystalParam{
-				Name:     fmt.Sprintf("arg%d", param.Number),
-				Type:     g.crystalType(param.Column),
-				Position: int(param.Number),
-			}
-
-			// Try to get a better name from the column
-			if param.Column.Name != "" {
-				p.Name = toSnakeCase(param.Column.Name)
+		// Server-side cursor iteration is opted into per query with an
+		// annotation comment, which is stripped from the doc comments
+		comments, batchSize, err := parseCursorAnnotation(query.Comments)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %w", query.Name, err)
+		}
+		if batchSize > 0 {
+			if query.Cmd != ":many" {
+				return nil, fmt.Errorf("query %s: @cursor is only supported on :many queries", query.Name)
 			}
-			
-			// Check if this parameter is used with sqlc.slice()
-			if param.Column.IsSqlcSlice {
-				// Force the type to be an array
-				baseType := g.baseType(param.Column)
-				p.Type = fmt.Sprintf("Array(%s)", baseType)
-				hasSlice = true
-				
-				// Add to slice params for template processing
-				cq.SliceParams = append(cq.SliceParams, sqlcSliceParam{
-					Name:        p.Name,
-					Placeholder: fmt.Sprintf("$%d", param.Number),
-				})
+			if g.req.Settings.Engine != "postgresql" {
+				return nil, fmt.Errorf("query %s: @cursor is only supported on postgresql", query.Name)
 			}
-
-			cq.Params = append(cq.Params, p)
 		}
-		
-		// Mark query as using sqlc.slice() if any param has it
-		if hasSlice {
-			cq.UsesSQLCSlice = true
+		cq.Comments = comments
+		cq.CursorBatchSize = batchSize
+
+		// Build parameter list
+		cq.Params, cq.SliceParams = g.buildParams(query)
+		cq.UsesSQLCSlice = len(cq.SliceParams) > 0
+
+		// PostgreSQL takes slices as native arrays instead of expanding them
+		if cq.UsesSQLCSlice && g.req.Settings.Engine == "postgresql" {
+			cq.SQL = rewritePostgresSlices(cq.SQL, cq.SliceParams)
 		}
 
+		g.applyUnsetNargs(query, &cq)
+
+		// Keyword-only parameters are declared in SQL order, since callers
+		// pass them by name and their order never matters
+		cq.KeywordParams = g.options.EmitKeywordParams
+
 		// Sort parameters to put required parameters before optional ones
 		// Required parameters are those without '?' suffix (non-nullable)
 		// Optional parameters are those with '?' suffix (nullable)
-		sort.SliceStable(cq.Params, func(i, j int) bool {
-			iIsOptional := strings.HasSuffix(cq.Params[i].Type, "?")
-			jIsOptional := strings.HasSuffix(cq.Params[j].Type, "?")
+		if !cq.KeywordParams {
+			sort.SliceStable(cq.Params, func(i, j int) bool {
+				iIsOptional := paramDefault(cq.Params[i]) != ""
+				jIsOptional := paramDefault(cq.Params[j]) != ""
+
+				// If one is optional and the other isn't, required comes first
+				if iIsOptional != jIsOptional {
+					return !iIsOptional // required (non-optional) comes first
+				}
 
-			// If one is optional and the other isn't, required comes first
-			if iIsOptional != jIsOptional {
-				return !iIsOptional // required (non-optional) comes first
-			}
+				// If both are the same type (both required or both optional),
+				// maintain original order by position
+				return cq.Params[i].Position < cq.Params[j].Position
+			})
+		}
 
-			// If both are the same type (both required or both optional),
-			// maintain original order by position
-			return cq.Params[i].Position < cq.Params[j].Position
-		})
+		// Bundle the parameters into a struct once there are too many of them
+		cq.ParamsStruct = g.paramsStructName(query)
+
+		if g.options.EmitMethodsWithDBArgument {
+			cq.DBParam = "db : Executor"
+		}
 
 		// Determine return type using deduplicated struct names
+		if query.Cmd == ":one" || query.Cmd == ":many" {
+			cq.ResultStruct, err = g.getStructNameForQuery(query)
+			if err != nil {
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
+			}
+		}
 		switch query.Cmd {
 		case ":one":
 			if len(query.Columns) == 1 {
 				cq.ReturnType = g.crystalType(query.Columns[0])
 			} else {
-				cq.ReturnType = g.getStructNameForQuery(query)
+				cq.ReturnType = cq.ResultStruct
 			}
 			cq.ReturnType += "?"
 		case ":many":
@@ -438,7 +672,7 @@ func (g *Generator) generateQueries() (*plugin.File, error) {
 				cq.ReturnType = "Array(" + g.crystalType(query.Columns[0]) + ")"
 				cq.SingleColumnType = g.crystalType(query.Columns[0])
 			} else {
-				cq.ReturnType = "Array(" + g.getStructNameForQuery(query) + ")"
+				cq.ReturnType = "Array(" + cq.ResultStruct + ")"
 			}
 		case ":exec":
 			cq.ReturnType = "Nil"
@@ -452,37 +686,404 @@ func (g *Generator) generateQueries() (*plugin.File, error) {
 			cq.ReturnType = "Int64"  // Will return number of rows copied
 		}
 
-		// Set the result struct name if needed
-		if len(query.Columns) > 1 && (query.Cmd == ":one" || query.Cmd == ":many") {
-			// Use deduplicated struct name
-			cq.ResultStruct = g.getStructNameForQuery(query)
-		} else if len(query.Columns) == 1 && (query.Cmd == ":one" || query.Cmd == ":many") {
-			// For single column queries, store the actual type (without ? or Array)
-			if query.Cmd == ":one" {
-				cq.SingleColumnType = g.crystalType(query.Columns[0])
-			}
+		// For single column queries, store the actual type (without ? or Array)
+		if len(query.Columns) == 1 && query.Cmd == ":one" {
+			cq.SingleColumnType = g.crystalType(query.Columns[0])
 		}
 
 		queries = append(queries, cq)
 	}
 
-	// Generate the queries file
+	return queries, nil
+}
+
+// generateQueries generates queries.cr and, when queries are split by
+// source file, one file per .sql file under queries/
+func (g *Generator) generateQueries(queries []crystalQuery) ([]*plugin.File, error) {
+	if !g.options.SplitQueriesByFile {
+		constant := fmt.Sprintf("SQL_%d_QUERIES", len(queries))
+		for i := range queries {
+			queries[i].SQLConstant = constant
+		}
+
+		file, err := g.renderQueries(g.options.QueriesFileName, templateData{
+			Header:      true,
+			Setup:       true,
+			ClassName:   "Queries",
+			SQLConstant: constant,
+			Queries:     queries,
+			AllQueries:  queries,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []*plugin.File{file}, nil
+	}
+
+	// Files are named after the base name of their .sql file, so two files
+	// with the same base name in different directories would be merged
+	paths := make(map[string]string)
+	for _, q := range queries {
+		name := toSnakeCase(q.SourceFile) + ".cr"
+		if other, ok := paths[name]; ok && other != q.sourcePath {
+			return nil, fmt.Errorf("query files %q and %q would both generate %s; give them different names", other, q.sourcePath, name)
+		}
+		paths[name] = q.sourcePath
+	}
+
+	// Each source file gets its own SQL constant, so the files can share
+	// one Queries class
+	for i := range queries {
+		queries[i].SQLConstant = "SQL_" + toConstantCase(queries[i].SourceFile) + "_QUERIES"
+	}
+
+	var files []*plugin.File
+	usesUnset := false
+	for _, q := range queries {
+		usesUnset = usesUnset || q.UsesUnset
+	}
+
+	// Definitions shared by every file, plus the Queries setup when the
+	// files reopen a single class
+	shared := templateData{Header: true, AllQueries: queries}
+	if !g.options.QueryClassPerFile {
+		shared.Setup = true
+		shared.ClassName = "Queries"
+	}
+	if shared.ClassName != "" || usesUnset || g.options.EmitPreparedQueries {
+		file, err := g.renderQueries(g.options.QueriesFileName, shared)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	dir := strings.TrimSuffix(g.options.QueriesFileName, ".cr")
+	for _, group := range groupQueriesByFile(queries) {
+		data := templateData{
+			ClassName:   "Queries",
+			Reopen:      true,
+			SQLConstant: group[0].SQLConstant,
+			Queries:     group,
+			AllQueries:  group,
+		}
+		if g.options.QueryClassPerFile {
+			data.ClassName = toPascalCase(group[0].SourceFile) + "Queries"
+			data.Reopen = false
+			data.Setup = true
+		}
+
+		file, err := g.renderQueries(dir+"/"+toSnakeCase(group[0].SourceFile)+".cr", data)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// renderQueries renders one queries file, filling in the options and the
+// features used by data.AllQueries
+func (g *Generator) renderQueries(name string, data templateData) (*plugin.File, error) {
+	for _, q := range data.AllQueries {
+		data.UsesUnset = data.UsesUnset || q.UsesUnset
+		data.UsesSliceExpansion = data.UsesSliceExpansion || needsSliceExpansion(q, g.req.Settings.Engine)
+	}
+
+	// Prepared queries run through the statement cache instead of the database
+	data.Executor = "@db"
+	if g.options.EmitPreparedQueries {
+		data.Executor = "@statements"
+	} else if g.options.EmitMethodsWithDBArgument {
+		data.Executor = "executor(db)"
+	}
+
+	data.Package = g.pkg
+	data.Engine = g.req.Settings.Engine
+	data.EmptySlices = g.options.EmptySlices
+	data.BucketSliceSizes = g.options.BucketSliceSizes
+	data.EmitPreparedQueries = g.options.EmitPreparedQueries
+	data.EmitInterface = g.options.EmitInterface
+	data.EmitMethodsWithDBArgument = g.options.EmitMethodsWithDBArgument
+
 	var buf bytes.Buffer
-	err := queriesTemplate.Execute(&buf, templateData{
-		Package: g.pkg,
-		Queries: queries,
-		Engine:  g.req.Settings.Engine,
-	})
-	if err != nil {
+	if err := queriesTemplate.Execute(&buf, data); err != nil {
 		return nil, err
 	}
 
 	return &plugin.File{
-		Name:     "queries.cr",
+		Name:     name,
 		Contents: buf.Bytes(),
 	}, nil
 }
 
+// requirePath turns a generated file name into the path database.cr
+// requires it by
+func requirePath(name string) string {
+	return "./" + strings.TrimSuffix(name, ".cr")
+}
+
+// sourceFileName returns the base name of a query's .sql file, made usable
+// in the class and constant names derived from it. Characters other than
+// letters, digits and underscores become underscores, and names starting
+// with a digit get a file_ prefix.
+func sourceFileName(filename string) string {
+	base := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+	if filename == "" || base == "" {
+		return "queries"
+	}
+	base = nonIdentifierChars.ReplaceAllString(base, "_")
+	if base[0] >= '0' && base[0] <= '9' {
+		base = "file_" + base
+	}
+	return base
+}
+
+var nonIdentifierChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// groupQueriesByFile groups queries by source file, in the order the files
+// first appear
+func groupQueriesByFile(queries []crystalQuery) [][]crystalQuery {
+	var groups [][]crystalQuery
+	index := make(map[string]int)
+	for _, q := range queries {
+		i, ok := index[q.SourceFile]
+		if !ok {
+			i = len(groups)
+			index[q.SourceFile] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], q)
+	}
+	return groups
+}
+
+// buildParams converts a query's parameters to Crystal parameters in SQL
+// order, along with the sqlc.slice() parameters that need expanding
+func (g *Generator) buildParams(query *plugin.Query) ([]crystalParam, []sqlcSliceParam) {
+	var params []crystalParam
+	var sliceParams []sqlcSliceParam
+
+	// Names the generated method body declares itself can't be used for
+	// parameters
+	var reserved []string
+	if hasCursorAnnotation(query.Comments) {
+		reserved = append(reserved, "batch_size", "conn", "tx", "batch")
+	}
+	if g.options.EmitMethodsWithDBArgument {
+		reserved = append(reserved, "db")
+	}
+	if g.paramsStructName(query) != "" {
+		reserved = append(reserved, "params")
+	}
+	engine := g.req.Settings.Engine
+	for _, param := range query.Params {
+		if param.Column.IsSqlcSlice && (engine == "mysql" || engine == "sqlite") {
+			reserved = append(reserved, "sql", "query_params")
+			break
+		}
+	}
+
+	names := paramNamesForQuery(query, g.options.ReservedNameStrategy, reserved...)
+	for i, param := range query.Params {
+		p := crystalParam{
+			Name:     names[i],
+			Type:     g.crystalType(param.Column),
+			Position: int(param.Number),
+		}
+
+		// Check if this parameter is used with sqlc.slice()
+		if param.Column.IsSqlcSlice {
+			// Force the type to be an array
+			baseType := g.baseType(param.Column)
+			p.Type = fmt.Sprintf("Array(%s)", baseType)
+
+			// Add to slice params for template processing
+			sliceParams = append(sliceParams, sqlcSliceParam{
+				Name:        p.Name,
+				Placeholder: fmt.Sprintf("$%d", param.Number),
+				Marker:      param.Column.Name,
+			})
+		}
+
+		params = append(params, p)
+	}
+
+	return params, sliceParams
+}
+
+// paramNamesForQuery picks a distinct Crystal name for every parameter of a
+// query. Parameters are named after their column, which collides when the
+// same column is compared more than once (e.g. a range on created_at), so
+// the later occurrences get a numeric suffix. Explicitly named parameters
+// (sqlc.arg/@name) keep their name and win over inferred ones, unless they
+// are reserved for the generated code. Names that are Crystal keywords are
+// escaped with the given strategy.
+func paramNamesForQuery(query *plugin.Query, strategy string, reserved ...string) []string {
+	names := make([]string, len(query.Params))
+	taken := make(map[string]bool)
+	for _, name := range reserved {
+		taken[name] = true
+	}
+
+	baseName := func(param *plugin.Parameter) string {
+		var name string
+		// sqlc reports expressions it can't name as "?column?"
+		if param.Column != nil && param.Column.Name != "" && param.Column.Name != "?column?" {
+			name = toSnakeCase(param.Column.Name)
+		} else if inferred := inferParamName(query.Text, int(param.Number)); inferred != "" {
+			name = toSnakeCase(inferred)
+		} else {
+			return fmt.Sprintf("arg%d", param.Number)
+		}
+		name, _ = escapeName(name, strategy)
+		return name
+	}
+
+	// Explicit names are reserved first so inferred names never take them
+	for i, param := range query.Params {
+		if param.Column != nil && param.Column.IsNamedParam && !taken[baseName(param)] {
+			names[i] = baseName(param)
+			taken[names[i]] = true
+		}
+	}
+
+	for i, param := range query.Params {
+		if names[i] != "" {
+			continue
+		}
+		base := baseName(param)
+		name := base
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		names[i] = name
+		taken[name] = true
+	}
+
+	return names
+}
+
+var (
+	limitOffsetContext = regexp.MustCompile(`(?i)\b(limit|offset)\s*$`)
+	inListContext      = regexp.MustCompile(`(?i)([\w.]+)\s*(?:=\s*any|not\s+in|in)\s*\(\s*$`)
+	comparisonContext  = regexp.MustCompile(`(?i)([\w.]+)\s*(?:=|<>|!=|<=|>=|<|>|\blike|\bilike)\s*$`)
+	funcCallContext    = regexp.MustCompile(`(?i)(\w+)\s*\(\s*$`)
+	numberedParam      = regexp.MustCompile(`[$?](\d+)\b`)
+	bareFuncNames      = map[string]bool{"any": true, "all": true, "in": true, "values": true, "coalesce": true, "exists": true}
+)
+
+// inferParamName guesses a name for a parameter sqlc couldn't name from the
+// SQL right before its placeholder: LIMIT/OFFSET, the column it's compared
+// against, or the function it's passed to. It returns "" if nothing fits.
+func inferParamName(sql string, number int) string {
+	idx := placeholderIndex(sql, number)
+	if idx < 0 {
+		return ""
+	}
+	before := sql[:idx]
+
+	if m := limitOffsetContext.FindStringSubmatch(before); m != nil {
+		return strings.ToLower(m[1])
+	}
+	if m := inListContext.FindStringSubmatch(before); m != nil {
+		return unqualified(m[1])
+	}
+	if m := comparisonContext.FindStringSubmatch(before); m != nil {
+		return unqualified(m[1])
+	}
+	if m := funcCallContext.FindStringSubmatch(before); m != nil && !bareFuncNames[strings.ToLower(m[1])] {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
+
+// placeholderIndex returns the offset of the placeholder for parameter
+// number in sql, handling both $N and positional ? placeholders
+func placeholderIndex(sql string, number int) int {
+	for _, loc := range numberedParam.FindAllStringSubmatchIndex(sql, -1) {
+		if n, err := strconv.Atoi(sql[loc[2]:loc[3]]); err == nil && n == number {
+			return loc[0]
+		}
+	}
+
+	// Positional placeholders are numbered in order of appearance
+	seen := 0
+	for i := 0; i < len(sql); i++ {
+		if sql[i] == '?' {
+			seen++
+			if seen == number {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// unqualified strips a table qualifier from a column reference
+func unqualified(ref string) string {
+	if i := strings.LastIndex(ref, "."); i >= 0 {
+		return ref[i+1:]
+	}
+	return ref
+}
+
+// paramsStructName returns the name of the generated params struct for a
+// query, or "" when the query is within the configured parameter limit
+func (g *Generator) paramsStructName(query *plugin.Query) string {
+	limit := g.options.QueryParameterLimit
+	if limit == nil || len(query.Params) == 0 || len(query.Params) <= int(*limit) {
+		return ""
+	}
+	return toPascalCase(query.Name) + "Params"
+}
+
+// defaultCursorBatchSize is the FETCH size used when a @cursor annotation
+// doesn't specify one
+const defaultCursorBatchSize = 1000
+
+// hasCursorAnnotation reports whether a query is annotated with @cursor
+func hasCursorAnnotation(comments []string) bool {
+	for _, comment := range comments {
+		if fields := strings.Fields(comment); len(fields) > 0 && fields[0] == "@cursor" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCursorAnnotation looks for a "@cursor" or "@cursor batch_size=N"
+// comment line. It returns the remaining comments and the batch size, which
+// is zero when the query isn't annotated.
+func parseCursorAnnotation(comments []string) ([]string, int, error) {
+	var rest []string
+	batchSize := 0
+
+	for _, comment := range comments {
+		fields := strings.Fields(comment)
+		if len(fields) == 0 || fields[0] != "@cursor" {
+			rest = append(rest, comment)
+			continue
+		}
+
+		batchSize = defaultCursorBatchSize
+		for _, opt := range fields[1:] {
+			value, ok := strings.CutPrefix(opt, "batch_size=")
+			if !ok {
+				return nil, 0, fmt.Errorf("unknown @cursor option %q", opt)
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, 0, fmt.Errorf("invalid @cursor batch_size %q", value)
+			}
+			batchSize = n
+		}
+	}
+
+	return rest, batchSize, nil
+}
+
 // crystalType converts a SQL column to a Crystal type
 func (g *Generator) crystalType(col *plugin.Column) string {
 	typ := g.baseType(col)
@@ -492,11 +1093,7 @@ func (g *Generator) crystalType(col *plugin.Column) string {
 	}
 
 	if !col.NotNull && !col.IsArray {
-		if g.options.EmitResultStructPointers {
-			typ = typ + "*"
-		} else {
-			typ = typ + "?"
-		}
+		typ = typ + "?"
 	}
 
 	return typ
@@ -529,6 +1126,7 @@ type crystalStruct struct {
 	Name      string
 	TableName string
 	Fields    []crystalField
+	Doc       []string
 }
 
 type crystalField struct {
@@ -536,6 +1134,10 @@ type crystalField struct {
 	DBName   string
 	JSONName string
 	Type     string
+	Doc      []string
+	Renamed  bool // escaped, so the DB key must always be given
+
+	table string // table the column comes from, if known
 }
 
 type crystalQuery struct {
@@ -551,31 +1153,74 @@ type crystalQuery struct {
 	SingleColumnType string
 	UsesSQLCSlice    bool
 	SliceParams      []sqlcSliceParam
+	CursorBatchSize  int
+	ParamsStruct     string
+	KeywordParams    bool
+	UsesUnset        bool
+	DBParam          string // leading db parameter when methods take the db
+	SourceFile       string // .sql file the query came from, without extension
+	SQLConstant      string // constant holding the query's SQL
+	sourcePath       string // .sql file as sqlc gave it
 }
 
 type crystalParam struct {
-	Name     string
-	Type     string
-	Position int
+	Name      string
+	Type      string
+	Position  int
+	UnsetFlag int // placeholder number of the "is set" flag for Unset nargs
 }
 
 type sqlcSliceParam struct {
 	Name        string
 	Placeholder string
+	Marker      string // name sqlc uses in the /*SLICE:name*/ marker
 }
 
 type templateData struct {
 	Package                   string
+	ModuleDoc                 []string
 	Structs                   []*crystalStruct
 	Queries                   []crystalQuery
 	EmitJSONTags              bool
 	EmitDBTags                bool
 	EmitBooleanQuestionGetters bool
+	EmitClasses               bool
+	EmitProperties            bool
 	Engine                    string
+	UsesUnset                 bool
+	EmptySlices               string
+	UsesSliceExpansion        bool
+	BucketSliceSizes          bool
+	EmitPreparedQueries       bool
+	EmitInterface             bool
+	EmitMethodsWithDBArgument bool
+	Executor                  string
+
+	// Layout of a queries file: Header holds the shared definitions, Setup
+	// the constructor and helpers of ClassName, and Reopen adds methods to
+	// a class set up in another file
+	Header      bool
+	Setup       bool
+	Reopen      bool
+	ClassName   string
+	SQLConstant string
+	AllQueries  []crystalQuery
+
+	// Files required at the top of a generated file
+	Requires []string
 }
 
-// generateDatabase generates the database.cr file as the main entry point
-func (g *Generator) generateDatabase() (*plugin.File, error) {
+// queriesType is the type other generated code uses to refer to the queries
+func (g *Generator) queriesType() string {
+	if g.options.EmitInterface {
+		return "Querier"
+	}
+	return "Queries"
+}
+
+// generateDatabase generates the database.cr file as the main entry point,
+// requiring the given model and query files
+func (g *Generator) generateDatabase(requires []string) (*plugin.File, error) {
 	tmpl, err := template.New("database").Funcs(template.FuncMap{
 		"crystalModule": crystalModuleName,
 	}).Parse(databaseTemplate)
@@ -587,10 +1232,20 @@ func (g *Generator) generateDatabase() (*plugin.File, error) {
 		Package                   string
 		GenerateConnectionManager bool
 		GenerateRepositories      bool
+		EmitInterface             bool
+		EmitMethodsWithDBArgument bool
+		QueriesInstance           bool
+		QueriesType               string
+		Requires                  []string
 	}{
 		Package:                   g.pkg,
 		GenerateConnectionManager: g.options.GenerateConnectionManager,
 		GenerateRepositories:      g.options.GenerateRepositories,
+		EmitInterface:             g.options.EmitInterface,
+		EmitMethodsWithDBArgument: g.options.EmitMethodsWithDBArgument,
+		QueriesInstance:           !g.options.EmitMethodsWithDBArgument && !g.options.QueryClassPerFile,
+		QueriesType:               g.queriesType(),
+		Requires:                  requires,
 	}
 
 	var buf bytes.Buffer
@@ -599,7 +1254,7 @@ func (g *Generator) generateDatabase() (*plugin.File, error) {
 	}
 
 	return &plugin.File{
-		Name:     "database.cr",
+		Name:     g.options.DatabaseFileName,
 		Contents: buf.Bytes(),
 	}, nil
 }
@@ -611,7 +1266,10 @@ func (g *Generator) generateRepositories() ([]*plugin.File, error) {
 	// Group queries by table
 	tableQueries := make(map[string][]crystalQuery)
 	for _, q := range g.req.Queries {
-		crystalQ := g.buildCrystalQuery(q)
+		crystalQ, err := g.buildCrystalQuery(q)
+		if err != nil {
+			return nil, err
+		}
 
 		// Try to determine the primary table from the query
 		tableName := g.extractTableName(q)
@@ -637,6 +1295,9 @@ func (g *Generator) generateRepositoryForTable(tableName string, queries []cryst
 	tmpl, err := template.New("repository").Funcs(template.FuncMap{
 		"paramList":     paramList,
 		"paramNames":    paramNames,
+		"methodParams":  methodParams,
+		"callArgs":      callArgs,
+		"joinParams":    joinParams,
 		"crystalModule": crystalModuleName,
 	}).Parse(repositoryTemplate)
 	if err != nil {
@@ -663,13 +1324,17 @@ func (g *Generator) generateRepositoryForTable(tableName string, queries []cryst
 	}
 
 	data := struct {
-		Package   string
-		TableName string
-		Methods   any
+		Package                   string
+		TableName                 string
+		Methods                   any
+		QueriesType               string
+		EmitMethodsWithDBArgument bool
 	}{
-		Package:   g.pkg,
-		TableName: toPascalCase(tableName),
-		Methods:   methods,
+		Package:                   g.pkg,
+		TableName:                 g.repositoryName(tableName),
+		Methods:                   methods,
+		QueriesType:               g.queriesType(),
+		EmitMethodsWithDBArgument: g.options.EmitMethodsWithDBArgument,
 	}
 
 	var buf bytes.Buffer
@@ -683,6 +1348,15 @@ func (g *Generator) generateRepositoryForTable(tableName string, queries []cryst
 	}, nil
 }
 
+// repositoryName is the name a table's repository module is prefixed
+// with: the table name, or the renamed struct name
+func (g *Generator) repositoryName(table string) string {
+	if name, ok := g.options.Rename[table]; ok {
+		return name
+	}
+	return toPascalCase(table)
+}
+
 // extractTableName attempts to extract the primary table name from a query
 func (g *Generator) extractTableName(q *plugin.Query) string {
 	// Simple heuristic: look for table name patterns in the query
@@ -750,7 +1424,7 @@ func (g *Generator) simplifyMethodName(methodName, tableName string) string {
 	// Convert to snake case for comparison
 	snakeMethod := toSnakeCase(methodName)
 	snakeTable := toSnakeCase(tableName)
-	singularTable := strings.TrimSuffix(snakeTable, "s")
+	singularTable := g.options.Inflector.Singularize(snakeTable)
 
 	// Handle specific patterns
 	if strings.HasPrefix(snakeMethod, "get_"+singularTable) {
@@ -784,7 +1458,7 @@ func (g *Generator) simplifyMethodName(methodName, tableName string) string {
 }
 
 // buildCrystalQuery converts a plugin query to a crystalQuery
-func (g *Generator) buildCrystalQuery(query *plugin.Query) crystalQuery {
+func (g *Generator) buildCrystalQuery(query *plugin.Query) (crystalQuery, error) {
 	cq := crystalQuery{
 		Name:         toSnakeCase(query.Name),
 		ConstantName: toConstantCase(query.Name),
@@ -794,65 +1468,47 @@ func (g *Generator) buildCrystalQuery(query *plugin.Query) crystalQuery {
 	}
 
 	// Build parameters
-	hasSlice := false
-	for i, param := range query.Params {
-		p := crystalParam{
-			Name:     fmt.Sprintf("arg%d", i+1),
-			Type:     g.crystalType(param.Column),
-			Position: i + 1,
-		}
-
-		// Use column name if available
-		if param.Column != nil && param.Column.Name != "" {
-			p.Name = toSnakeCase(param.Column.Name)
-		}
-		
-		// Check if this parameter is used with sqlc.slice()
-		if param.Column != nil && param.Column.IsSqlcSlice {
-			// Force the type to be an array
-			baseType := g.baseType(param.Column)
-			p.Type = fmt.Sprintf("Array(%s)", baseType)
-			hasSlice = true
-			
-			// Add to slice params for template processing
-			cq.SliceParams = append(cq.SliceParams, sqlcSliceParam{
-				Name:        p.Name,
-				Placeholder: fmt.Sprintf("$%d", param.Number),
-			})
-		}
+	cq.Params, cq.SliceParams = g.buildParams(query)
+	cq.UsesSQLCSlice = len(cq.SliceParams) > 0
+	g.applyUnsetNargs(query, &cq)
 
-		cq.Params = append(cq.Params, p)
-	}
-	
-	// Mark query as using sqlc.slice() if any param has it
-	if hasSlice {
-		cq.UsesSQLCSlice = true
-	}
+	cq.KeywordParams = g.options.EmitKeywordParams
 
 	// Sort parameters to put required parameters before optional ones
 	// Required parameters are those without '?' suffix (non-nullable)
 	// Optional parameters are those with '?' suffix (nullable)
-	sort.SliceStable(cq.Params, func(i, j int) bool {
-		iIsOptional := strings.HasSuffix(cq.Params[i].Type, "?")
-		jIsOptional := strings.HasSuffix(cq.Params[j].Type, "?")
+	if !cq.KeywordParams {
+		sort.SliceStable(cq.Params, func(i, j int) bool {
+			iIsOptional := paramDefault(cq.Params[i]) != ""
+			jIsOptional := paramDefault(cq.Params[j]) != ""
 
-		// If one is optional and the other isn't, required comes first
-		if iIsOptional != jIsOptional {
-			return !iIsOptional // required (non-optional) comes first
-		}
+			// If one is optional and the other isn't, required comes first
+			if iIsOptional != jIsOptional {
+				return !iIsOptional // required (non-optional) comes first
+			}
 
-		// If both are the same type (both required or both optional),
-		// maintain original order by position
-		return cq.Params[i].Position < cq.Params[j].Position
-	})
+			// If both are the same type (both required or both optional),
+			// maintain original order by position
+			return cq.Params[i].Position < cq.Params[j].Position
+		})
+	}
+
+	cq.ParamsStruct = g.paramsStructName(query)
 
 	// Determine return type using deduplicated struct names (same logic as generateQueries)
+	if query.Cmd == ":one" || query.Cmd == ":many" {
+		var err error
+		cq.ResultStruct, err = g.getStructNameForQuery(query)
+		if err != nil {
+			return crystalQuery{}, fmt.Errorf("query %s: %w", query.Name, err)
+		}
+	}
 	switch query.Cmd {
 	case ":one":
 		if len(query.Columns) == 1 {
 			cq.ReturnType = g.crystalType(query.Columns[0])
 		} else {
-			cq.ReturnType = g.getStructNameForQuery(query)
+			cq.ReturnType = cq.ResultStruct
 		}
 		cq.ReturnType += "?"
 	case ":many":
@@ -860,7 +1516,7 @@ func (g *Generator) buildCrystalQuery(query *plugin.Query) crystalQuery {
 			cq.ReturnType = "Array(" + g.crystalType(query.Columns[0]) + ")"
 			cq.SingleColumnType = g.crystalType(query.Columns[0])
 		} else {
-			cq.ReturnType = "Array(" + g.getStructNameForQuery(query) + ")"
+			cq.ReturnType = "Array(" + cq.ResultStruct + ")"
 		}
 	case ":exec":
 		cq.ReturnType = "Nil"
@@ -874,16 +1530,10 @@ func (g *Generator) buildCrystalQuery(query *plugin.Query) crystalQuery {
 		cq.ReturnType = "Int64"  // Will return number of rows copied
 	}
 
-	// Set the result struct name if needed using deduplicated names
-	if len(query.Columns) > 1 && (query.Cmd == ":one" || query.Cmd == ":many") {
-		// Use deduplicated struct name
-		cq.ResultStruct = g.getStructNameForQuery(query)
-	} else if len(query.Columns) == 1 && (query.Cmd == ":one" || query.Cmd == ":many") {
-		// For single column queries, store the actual type (without ? or Array)
-		if query.Cmd == ":one" {
-			cq.SingleColumnType = g.crystalType(query.Columns[0])
-		}
+	// For single column queries, store the actual type (without ? or Array)
+	if len(query.Columns) == 1 && query.Cmd == ":one" {
+		cq.SingleColumnType = g.crystalType(query.Columns[0])
 	}
 
-	return cq
+	return cq, nil
 }
@@ -1,6 +1,7 @@
 package crystal
 
 import (
+	"bytes"
 	"context"
 	"strings"
 	"testing"
@@ -500,6 +501,23 @@ func TestParameterOrdering(t *testing.T) {
 	if !strings.Contains(queriesContent, expectedCallOrder) {
 		t.Errorf("Expected parameters in original SQL order in query call: %s\nGot:\n%s", expectedCallOrder, queriesContent)
 	}
+
+	// Repositories forward by name, since the reordered signature no longer
+	// matches SQL order
+	resp, err = NewGenerator(req, "db", GeneratorOptions{GenerateRepositories: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	var repoContent string
+	for _, file := range resp.Files {
+		if file.Name == "repositories/books_repository.cr" {
+			repoContent = string(file.Contents)
+		}
+	}
+	expected := "Database.queries.create_book(author_id: author_id, title: title, description: description, price: price, isbn: isbn, published: published)"
+	if !strings.Contains(repoContent, expected) {
+		t.Errorf("Expected %q in the books repository, got:\n%s", expected, repoContent)
+	}
 }
 
 func TestAllRequiredParameters(t *testing.T) {
@@ -871,3 +889,2142 @@ func TestIsBooleanType(t *testing.T) {
 		})
 	}
 }
+
+func TestStreamingManyQueries(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "ListAuthorsByName",
+				Text: "SELECT id, name FROM authors WHERE name = $1",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{
+						Number: 1,
+						Column: &plugin.Column{
+							Name:    "name",
+							Type:    &plugin.Identifier{Name: "text"},
+							NotNull: true,
+						},
+					},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "ListAuthorIds",
+				Text: "SELECT id FROM authors",
+				Cmd:  ":many",
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+				},
+			},
+			{
+				Name: "GetAuthorName",
+				Text: "SELECT name FROM authors WHERE id = $1",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{
+						Number: 1,
+						Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					},
+				},
+				Columns: []*plugin.Column{
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	gen := NewGenerator(req, "db", GeneratorOptions{})
+
+	resp, err := gen.Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	queriesContent := string(resp.Files[0].Contents)
+
+	// The array-returning method is still generated
+	if !strings.Contains(queriesContent, "def list_authors_by_name(name : String) : Array(ListAuthorsByNameRow)") {
+		t.Errorf("Expected array-returning method to be kept, got:\n%s", queriesContent)
+	}
+
+	// Struct rows are streamed through a block
+	if !strings.Contains(queriesContent, "def each_list_authors_by_name(name : String, & : ListAuthorsByNameRow ->) : Nil") {
+		t.Errorf("Expected streaming variant for struct rows, got:\n%s", queriesContent)
+	}
+
+	// Single-column rows are streamed with their scalar type
+	if !strings.Contains(queriesContent, "def each_list_author_ids(& : Int32 ->) : Nil") {
+		t.Errorf("Expected streaming variant for single-column rows, got:\n%s", queriesContent)
+	}
+
+	if !strings.Contains(queriesContent, "@db.query_each(") {
+		t.Error("Streaming variants should read rows with query_each")
+	}
+
+	if !strings.Contains(queriesContent, "yield rs.read(ListAuthorsByNameRow)") {
+		t.Error("Streaming variants should yield one row at a time")
+	}
+
+	// :one queries don't get a streaming variant
+	if strings.Contains(queriesContent, "def each_get_author_name") {
+		t.Error("Only :many queries should get a streaming variant")
+	}
+}
+
+func TestCursorAnnotation(t *testing.T) {
+	newReq := func(engine, cmd string, comments []string) *plugin.GenerateRequest {
+		return &plugin.GenerateRequest{
+			Settings: &plugin.Settings{
+				Engine: engine,
+			},
+			Queries: []*plugin.Query{
+				{
+					Name:     "ListEvents",
+					Text:     "SELECT id, payload FROM events WHERE created_at > $1",
+					Cmd:      cmd,
+					Comments: comments,
+					Params: []*plugin.Parameter{
+						{
+							Number: 1,
+							Column: &plugin.Column{
+								Name:    "created_at",
+								Type:    &plugin.Identifier{Name: "timestamptz"},
+								NotNull: true,
+							},
+						},
+					},
+					Columns: []*plugin.Column{
+						{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+						{Name: "payload", Type: &plugin.Identifier{Name: "jsonb"}, NotNull: true},
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("annotated query gets each_batch variant", func(t *testing.T) {
+		req := newReq("postgresql", ":many", []string{"Export events", "@cursor batch_size=500"})
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		queriesContent := string(resp.Files[0].Contents)
+
+		expectedSignature := "def each_batch_list_events(created_at : Time, batch_size : Int32 = 500, & : Array(ListEventsRow) ->) : Nil"
+		if !strings.Contains(queriesContent, expectedSignature) {
+			t.Errorf("Expected batched cursor method:\n%s\nGot:\n%s", expectedSignature, queriesContent)
+		}
+
+		if !strings.Contains(queriesContent, `"DECLARE list_events_cursor NO SCROLL CURSOR FOR " + SQL_1_QUERIES[:LIST_EVENTS]`) {
+			t.Error("Cursor method should declare a cursor over the query SQL")
+		}
+
+		if !strings.Contains(queriesContent, `FETCH FORWARD #{batch_size} FROM list_events_cursor`) {
+			t.Error("Cursor method should fetch in batches")
+		}
+
+		// The annotation itself is not part of the doc comment
+		if strings.Contains(queriesContent, "@cursor") {
+			t.Error("@cursor annotation should be stripped from comments")
+		}
+
+		if !strings.Contains(queriesContent, "# Export events") {
+			t.Error("Other comments should be kept")
+		}
+	})
+
+	t.Run("batch method on a transaction-bound Queries", func(t *testing.T) {
+		for _, prepared := range []bool{false, true} {
+			req := newReq("postgresql", ":many", []string{"@cursor"})
+			resp, err := NewGenerator(req, "db", GeneratorOptions{EmitPreparedQueries: prepared}).Generate(context.Background())
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+
+			queriesContent := string(resp.Files[0].Contents)
+
+			// with_tx keeps the transaction, so the cursor opens a savepoint
+			// inside it instead of a second top-level transaction
+			for _, expected := range []string{
+				"@tx : DB::Transaction?",
+				"(@tx || @db).transaction do |tx|",
+			} {
+				if !strings.Contains(queriesContent, expected) {
+					t.Errorf("prepared=%v: expected:\n%s\nGot:\n%s", prepared, expected, queriesContent)
+				}
+			}
+		}
+	})
+
+	t.Run("parameters named like the cursor variables", func(t *testing.T) {
+		req := newReq("postgresql", ":many", []string{"@cursor batch_size=10"})
+		query := req.Queries[0]
+		query.Text = "SELECT id, payload FROM events WHERE batch_size = $1 AND conn = $2"
+		query.Params = []*plugin.Parameter{
+			{Number: 1, Column: &plugin.Column{Name: "batch_size", Type: &plugin.Identifier{Name: "int4"}, NotNull: true, IsNamedParam: true}},
+			{Number: 2, Column: &plugin.Column{Name: "conn", Type: &plugin.Identifier{Name: "text"}, NotNull: true}},
+		}
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		expected := "def each_batch_list_events(batch_size_2 : Int32, conn_2 : String, batch_size : Int32 = 10, & : Array(ListEventsRow) ->) : Nil"
+		if !strings.Contains(string(resp.Files[0].Contents), expected) {
+			t.Errorf("Expected %q, got:\n%s", expected, resp.Files[0].Contents)
+		}
+	})
+
+	t.Run("default batch size", func(t *testing.T) {
+		req := newReq("postgresql", ":many", []string{"@cursor"})
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		if !strings.Contains(string(resp.Files[0].Contents), "batch_size : Int32 = 1000") {
+			t.Error("Expected default batch size of 1000")
+		}
+	})
+
+	t.Run("unannotated query has no each_batch variant", func(t *testing.T) {
+		req := newReq("postgresql", ":many", nil)
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		if strings.Contains(string(resp.Files[0].Contents), "each_batch_") {
+			t.Error("Cursor iteration should be opt-in")
+		}
+	})
+
+	errorCases := []struct {
+		name     string
+		engine   string
+		cmd      string
+		comments []string
+	}{
+		{"non-postgres engine", "mysql", ":many", []string{"@cursor"}},
+		{"non-many query", "postgresql", ":one", []string{"@cursor"}},
+		{"invalid batch size", "postgresql", ":many", []string{"@cursor batch_size=0"}},
+		{"unknown option", "postgresql", ":many", []string{"@cursor size=10"}},
+	}
+
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newReq(tt.engine, tt.cmd, tt.comments)
+			if _, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background()); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestQueryParameterLimit(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "CreateBook",
+				Text: "INSERT INTO books (author_id, title, isbn) VALUES ($1, $2, $3) RETURNING id, title",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "author_id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true}},
+					{Number: 2, Column: &plugin.Column{Name: "title", Type: &plugin.Identifier{Name: "text"}, NotNull: true}},
+					{Number: 3, Column: &plugin.Column{Name: "isbn", Type: &plugin.Identifier{Name: "text"}, NotNull: false}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "title", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "DeleteBook",
+				Text: "DELETE FROM books WHERE id = $1",
+				Cmd:  ":exec",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true}},
+				},
+			},
+		},
+	}
+
+	t.Run("without a limit", func(t *testing.T) {
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		queriesContent := string(resp.Files[0].Contents)
+		if strings.Contains(queriesContent, "CreateBookParams") {
+			t.Error("Params structs should not be generated without query_parameter_limit")
+		}
+	})
+
+	t.Run("above the limit", func(t *testing.T) {
+		limit := int32(2)
+		resp, err := NewGenerator(req, "db", GeneratorOptions{
+			QueryParameterLimit:  &limit,
+			GenerateRepositories: true,
+		}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		queriesContent := string(resp.Files[0].Contents)
+
+		if !strings.Contains(queriesContent, "struct CreateBookParams") {
+			t.Errorf("Expected CreateBookParams struct, got:\n%s", queriesContent)
+		}
+
+		if !strings.Contains(queriesContent, "def initialize(*, @author_id : Int32, @title : String, @isbn : String? = nil)") {
+			t.Errorf("Expected keyword initializer in SQL order, got:\n%s", queriesContent)
+		}
+
+		if !strings.Contains(queriesContent, "def create_book(params : CreateBookParams) : CreateBookRow?") {
+			t.Errorf("Expected method to accept the params struct, got:\n%s", queriesContent)
+		}
+
+		if !strings.Contains(queriesContent, "author_id = params.author_id\n      title = params.title\n      isbn = params.isbn") {
+			t.Errorf("Expected params struct to be unpacked in SQL order, got:\n%s", queriesContent)
+		}
+
+		// Queries within the limit keep positional arguments
+		if !strings.Contains(queriesContent, "def delete_book(id : Int32) : Nil") {
+			t.Error("Queries within the limit should keep positional arguments")
+		}
+		if strings.Contains(queriesContent, "DeleteBookParams") {
+			t.Error("Queries within the limit should not get a params struct")
+		}
+
+		var repoContent string
+		for _, f := range resp.Files {
+			if strings.HasPrefix(f.Name, "repositories/") {
+				repoContent = string(f.Contents)
+			}
+		}
+
+		if !strings.Contains(repoContent, "def create(params : CreateBookParams) : CreateBookRow?") {
+			t.Errorf("Expected repository to accept the params struct, got:\n%s", repoContent)
+		}
+
+		if !strings.Contains(repoContent, "Database.queries.create_book(params)") {
+			t.Errorf("Expected repository to forward the params struct, got:\n%s", repoContent)
+		}
+	})
+
+	t.Run("zero limit", func(t *testing.T) {
+		limit := int32(0)
+		resp, err := NewGenerator(req, "db", GeneratorOptions{QueryParameterLimit: &limit}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		if !strings.Contains(string(resp.Files[0].Contents), "def delete_book(params : DeleteBookParams) : Nil") {
+			t.Error("A zero limit should put every parameter into a struct")
+		}
+	})
+
+	t.Run("parameters named like the method's variables", func(t *testing.T) {
+		limit := int32(1)
+		req := &plugin.GenerateRequest{
+			Settings: &plugin.Settings{
+				Engine: "mysql",
+			},
+			Queries: []*plugin.Query{
+				{
+					Name: "ListReports",
+					Text: "SELECT id FROM reports WHERE id IN (/*SLICE:ids*/?) AND params = ? AND `sql` = ?",
+					Cmd:  ":many",
+					Params: []*plugin.Parameter{
+						{Number: 1, Column: &plugin.Column{Name: "ids", Type: &plugin.Identifier{Name: "int"}, NotNull: true, IsSqlcSlice: true}},
+						{Number: 2, Column: &plugin.Column{Name: "params", Type: &plugin.Identifier{Name: "text"}, NotNull: true, IsNamedParam: true}},
+						{Number: 3, Column: &plugin.Column{Name: "sql", Type: &plugin.Identifier{Name: "text"}, NotNull: true}},
+					},
+					Columns: []*plugin.Column{
+						{Name: "id", Type: &plugin.Identifier{Name: "int"}, NotNull: true},
+					},
+				},
+			},
+		}
+		resp, err := NewGenerator(req, "db", GeneratorOptions{QueryParameterLimit: &limit}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		queriesContent := string(resp.Files[0].Contents)
+		for _, expected := range []string{
+			"def initialize(*, @ids : Array(Int32), @params_2 : String, @sql_2 : String)",
+			"def list_reports(params : ListReportsParams) : Array(Int32)",
+			"params_2 = params.params_2",
+			"sql_2 = params.sql_2",
+			"query_params << sql_2.as(DB::Any)",
+		} {
+			if !strings.Contains(queriesContent, expected) {
+				t.Errorf("Expected %q, got:\n%s", expected, queriesContent)
+			}
+		}
+	})
+}
+
+func TestDuplicateParameterNames(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "ListEventsBetween",
+				Text: "SELECT id, name FROM events WHERE created_at > $1 AND created_at < $2",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "created_at", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true}},
+					{Number: 2, Column: &plugin.Column{Name: "created_at", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "CountRecentEvents",
+				Text: "SELECT count(*) FROM events WHERE created_at > $1 AND created_at < $2",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "created_at", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true}},
+					// sqlc.arg(created_at) explicitly claims the plain name
+					{Number: 2, Column: &plugin.Column{Name: "created_at", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true, IsNamedParam: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "count", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	gen := NewGenerator(req, "db", GeneratorOptions{})
+
+	resp, err := gen.Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	queriesContent := string(resp.Files[0].Contents)
+
+	expectedSignature := "def list_events_between(created_at : Time, created_at_2 : Time) : Array(ListEventsBetweenRow)"
+	if !strings.Contains(queriesContent, expectedSignature) {
+		t.Errorf("Expected colliding parameters to get distinct names:\n%s\nGot:\n%s", expectedSignature, queriesContent)
+	}
+
+	if !strings.Contains(queriesContent, "created_at, created_at_2,") {
+		t.Errorf("Expected distinct parameters to be passed in SQL order, got:\n%s", queriesContent)
+	}
+
+	expectedSignature = "def count_recent_events(created_at_2 : Time, created_at : Time) : Int64?"
+	if !strings.Contains(queriesContent, expectedSignature) {
+		t.Errorf("Expected named parameter to keep its name:\n%s\nGot:\n%s", expectedSignature, queriesContent)
+	}
+
+	if !strings.Contains(queriesContent, "created_at_2, created_at\n") {
+		t.Errorf("Expected parameters to map to their original positions, got:\n%s", queriesContent)
+	}
+}
+
+func TestKeywordParams(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "CreateBook",
+				Text: "INSERT INTO books (author_id, description, title) VALUES ($1, $2, $3) RETURNING id, title",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "author_id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true}},
+					{Number: 2, Column: &plugin.Column{Name: "description", Type: &plugin.Identifier{Name: "text"}, NotNull: false}},
+					{Number: 3, Column: &plugin.Column{Name: "title", Type: &plugin.Identifier{Name: "text"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "title", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "ListBooks",
+				Text: "SELECT id, title FROM books",
+				Cmd:  ":many",
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "title", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	gen := NewGenerator(req, "db", GeneratorOptions{
+		EmitKeywordParams:    true,
+		GenerateRepositories: true,
+	})
+
+	resp, err := gen.Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	queriesContent := string(resp.Files[0].Contents)
+
+	// Parameters stay in SQL order even though a nullable one comes first
+	expectedSignature := "def create_book(*, author_id : Int32, description : String? = nil, title : String) : CreateBookRow?"
+	if !strings.Contains(queriesContent, expectedSignature) {
+		t.Errorf("Expected keyword-only parameters in SQL order:\n%s\nGot:\n%s", expectedSignature, queriesContent)
+	}
+
+	// Queries without parameters don't get a bare splat
+	if !strings.Contains(queriesContent, "def list_books() : Array(ListBooksRow)") {
+		t.Errorf("Expected parameterless method without splat, got:\n%s", queriesContent)
+	}
+	if !strings.Contains(queriesContent, "def each_list_books(& : ListBooksRow ->) : Nil") {
+		t.Errorf("Expected parameterless streaming method without splat, got:\n%s", queriesContent)
+	}
+
+	var repoContent string
+	for _, f := range resp.Files {
+		if strings.HasPrefix(f.Name, "repositories/") {
+			repoContent = string(f.Contents)
+		}
+	}
+
+	if !strings.Contains(repoContent, "def create(*, author_id : Int32, description : String? = nil, title : String) : CreateBookRow?") {
+		t.Errorf("Expected repository to take keyword-only parameters, got:\n%s", repoContent)
+	}
+
+	if !strings.Contains(repoContent, "Database.queries.create_book(author_id: author_id, description: description, title: title)") {
+		t.Errorf("Expected repository to call through with named arguments, got:\n%s", repoContent)
+	}
+}
+
+func TestUnsetNargs(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "PatchAuthor",
+				Text: "UPDATE authors SET name = COALESCE($2, name), bio = COALESCE($3::text, bio) WHERE id = $1",
+				Cmd:  ":exec",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true}},
+					{Number: 2, Column: &plugin.Column{Name: "name", Type: &plugin.Identifier{Name: "text"}, IsNamedParam: true}},
+					{Number: 3, Column: &plugin.Column{Name: "bio", Type: &plugin.Identifier{Name: "text"}, IsNamedParam: true}},
+				},
+			},
+			{
+				Name: "ListAuthorsByBio",
+				Text: "SELECT id, name FROM authors WHERE bio = $1",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "bio", Type: &plugin.Identifier{Name: "text"}, IsNamedParam: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		queriesContent := string(resp.Files[0].Contents)
+		if strings.Contains(queriesContent, "Unset") {
+			t.Errorf("Unset should only be generated when enabled, got:\n%s", queriesContent)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		resp, err := NewGenerator(req, "db", GeneratorOptions{EmitUnsetNargs: true}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+
+		queriesContent := string(resp.Files[0].Contents)
+
+		if !strings.Contains(queriesContent, "struct Unset") {
+			t.Errorf("Expected Unset sentinel type, got:\n%s", queriesContent)
+		}
+
+		expectedSignature := "def patch_author(id : Int32, name : String? | Unset = Unset.new, bio : String? | Unset = Unset.new) : Nil"
+		if !strings.Contains(queriesContent, expectedSignature) {
+			t.Errorf("Expected tri-state parameters:\n%s\nGot:\n%s", expectedSignature, queriesContent)
+		}
+
+		expectedSQL := `name = CASE WHEN $4::boolean THEN $2 ELSE name END, bio = CASE WHEN $5::boolean THEN $3::text ELSE bio END WHERE id = $1`
+		if !strings.Contains(queriesContent, expectedSQL) {
+			t.Errorf("Expected COALESCE to be rewritten:\n%s\nGot:\n%s", expectedSQL, queriesContent)
+		}
+
+		expectedArgs := "id, (name.is_a?(Unset) ? nil : name), (bio.is_a?(Unset) ? nil : bio), !name.is_a?(Unset), !bio.is_a?(Unset)"
+		if !strings.Contains(queriesContent, expectedArgs) {
+			t.Errorf("Expected values followed by set flags:\n%s\nGot:\n%s", expectedArgs, queriesContent)
+		}
+
+		// nargs outside of COALESCE keep plain nil semantics
+		if !strings.Contains(queriesContent, "def list_authors_by_bio(bio : String? = nil) : Array(ListAuthorsByBioRow)") {
+			t.Errorf("Expected narg outside COALESCE to stay nilable, got:\n%s", queriesContent)
+		}
+	})
+
+	// Option validation rejects other engines; the generator itself leaves
+	// their queries alone
+	t.Run("unsupported engine", func(t *testing.T) {
+		mysqlReq := &plugin.GenerateRequest{
+			Settings: &plugin.Settings{Engine: "mysql"},
+			Queries:  req.Queries,
+		}
+		resp, err := NewGenerator(mysqlReq, "db", GeneratorOptions{EmitUnsetNargs: true}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		if queriesContent := string(resp.Files[0].Contents); strings.Contains(queriesContent, "Unset") {
+			t.Errorf("Unset should only be generated on postgresql, got:\n%s", queriesContent)
+		}
+	})
+}
+
+func TestRewriteCoalesce(t *testing.T) {
+	tests := []struct {
+		name      string
+		sql       string
+		expected  string
+		rewritten bool
+	}{
+		{
+			name:      "simple",
+			sql:       "SET bio = COALESCE($2, bio)",
+			expected:  "SET bio = CASE WHEN $9::boolean THEN $2 ELSE bio END",
+			rewritten: true,
+		},
+		{
+			name:      "nested fallback",
+			sql:       "SET bio = coalesce($2, lower(bio)) WHERE id = $1",
+			expected:  "SET bio = CASE WHEN $9::boolean THEN $2 ELSE lower(bio) END WHERE id = $1",
+			rewritten: true,
+		},
+		{
+			name:      "other placeholder",
+			sql:       "SET bio = COALESCE($20, bio)",
+			expected:  "SET bio = COALESCE($20, bio)",
+			rewritten: false,
+		},
+		{
+			name:      "more than two arguments",
+			sql:       "SET bio = COALESCE($2, bio, 'none')",
+			expected:  "SET bio = COALESCE($2, bio, 'none')",
+			rewritten: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, rewritten := rewriteCoalesce(tt.sql, 2, 9)
+			if result != tt.expected || rewritten != tt.rewritten {
+				t.Errorf("rewriteCoalesce() = %q, %v; want %q, %v", result, rewritten, tt.expected, tt.rewritten)
+			}
+		})
+	}
+}
+
+func TestInferParamName(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		number   int
+		expected string
+	}{
+		{"limit", "SELECT * FROM authors ORDER BY name LIMIT $1 OFFSET $2", 1, "limit"},
+		{"offset", "SELECT * FROM authors ORDER BY name LIMIT $1 OFFSET $2", 2, "offset"},
+		{"comparison", "SELECT * FROM authors WHERE a.age >= $1", 1, "age"},
+		{"like", "SELECT * FROM authors WHERE name ILIKE $1", 1, "name"},
+		{"any", "SELECT * FROM authors WHERE id = ANY($1::int[])", 1, "id"},
+		{"function argument", "SELECT * FROM authors WHERE created_at > now() - make_interval(days => 1) AND to_tsquery($1) @@ search", 1, "to_tsquery"},
+		{"positional placeholders", "SELECT * FROM authors WHERE name = ? LIMIT ?", 2, "limit"},
+		{"no context", "SELECT $1::int", 1, ""},
+		{"does not match longer placeholder", "SELECT * FROM t WHERE a = $10 LIMIT $1", 1, "limit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := inferParamName(tt.sql, tt.number)
+			if result != tt.expected {
+				t.Errorf("inferParamName(%q, %d) = %q, want %q", tt.sql, tt.number, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnnamedParameterNames(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "ListAuthorsPage",
+				Text: "SELECT id, name FROM authors WHERE age > $1 ORDER BY name LIMIT $2 OFFSET $3",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "max_age", Type: &plugin.Identifier{Name: "int4"}, NotNull: true, IsNamedParam: true}},
+					{Number: 2, Column: &plugin.Column{Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+					{Number: 3, Column: &plugin.Column{Name: "?column?", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "Echo",
+				Text: "SELECT $1::int",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Type: &plugin.Identifier{Name: "int4"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "int4", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	queriesContent := string(resp.Files[0].Contents)
+
+	expectedSignature := "def list_authors_page(max_age : Int32, limit : Int64, offset : Int64) : Array(ListAuthorsPageRow)"
+	if !strings.Contains(queriesContent, expectedSignature) {
+		t.Errorf("Expected named and inferred parameter names:\n%s\nGot:\n%s", expectedSignature, queriesContent)
+	}
+
+	// argN is only the last resort
+	if !strings.Contains(queriesContent, "def echo(arg1 : Int32) : Int32?") {
+		t.Errorf("Expected argN fallback when no name can be derived, got:\n%s", queriesContent)
+	}
+}
+
+func TestPostgresSliceParams(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "ListAuthorsByIds",
+				Text: "SELECT id, name FROM authors WHERE id IN (/*SLICE:ids*/$1) AND name NOT IN ($2)",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "ids", Type: &plugin.Identifier{Name: "int4"}, NotNull: true, IsSqlcSlice: true}},
+					{Number: 2, Column: &plugin.Column{Name: "names", Type: &plugin.Identifier{Name: "text"}, NotNull: true, IsSqlcSlice: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int4"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	queriesContent := string(resp.Files[0].Contents)
+
+	if !strings.Contains(queriesContent, "def list_authors_by_ids(ids : Array(Int32), names : Array(String)) : Array(ListAuthorsByIdsRow)") {
+		t.Errorf("Expected slice parameters to be arrays, got:\n%s", queriesContent)
+	}
+
+	if !strings.Contains(queriesContent, `WHERE id = ANY($1) AND name <> ALL($2)`) {
+		t.Errorf("Expected IN lists to be rewritten to array comparisons, got:\n%s", queriesContent)
+	}
+
+	// Arrays are sent as-is rather than expanded into placeholders
+	if strings.Contains(queriesContent, "@@expanded_sql") || strings.Contains(queriesContent, "/*SLICE:") {
+		t.Errorf("PostgreSQL slices should not be expanded, got:\n%s", queriesContent)
+	}
+}
+
+func TestEmptySlices(t *testing.T) {
+	sliceParam := &plugin.Parameter{
+		Number: 1,
+		Column: &plugin.Column{Name: "ids", Type: &plugin.Identifier{Name: "integer"}, NotNull: true, IsSqlcSlice: true},
+	}
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "sqlite",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name:   "GetUserByIds",
+				Text:   "SELECT id, name FROM users WHERE id IN (/*SLICE:ids*/?) LIMIT 1",
+				Cmd:    ":one",
+				Params: []*plugin.Parameter{sliceParam},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "integer"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name:   "ListUsersByIds",
+				Text:   "SELECT id, name FROM users WHERE id IN (/*SLICE:ids*/?)",
+				Cmd:    ":many",
+				Params: []*plugin.Parameter{sliceParam},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "integer"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name:   "DeleteUsers",
+				Text:   "DELETE FROM users WHERE id IN (/*SLICE:ids*/?)",
+				Cmd:    ":exec",
+				Params: []*plugin.Parameter{sliceParam},
+			},
+			{
+				Name:   "DeactivateUsers",
+				Text:   "UPDATE users SET active = 0 WHERE id IN (/*SLICE:ids*/?)",
+				Cmd:    ":execrows",
+				Params: []*plugin.Parameter{sliceParam},
+			},
+		},
+	}
+
+	generate := func(t *testing.T, emptySlices string) string {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", GeneratorOptions{EmptySlices: emptySlices}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		return string(resp.Files[0].Contents)
+	}
+
+	t.Run("raise", func(t *testing.T) {
+		queriesContent := generate(t, EmptySlicesRaise)
+		if strings.Count(queriesContent, `raise ArgumentError.new("slice parameter 'ids' cannot be empty")`) != 5 {
+			t.Errorf("Expected every method to raise on empty slices, got:\n%s", queriesContent)
+		}
+	})
+
+	t.Run("short circuit", func(t *testing.T) {
+		queriesContent := generate(t, EmptySlicesShortCircuit)
+
+		for _, expected := range []string{
+			"if ids.empty?\n        return nil\n      end",
+			"if ids.empty?\n        return [] of ListUsersByIdsRow\n      end",
+			"if ids.empty?\n        return 0_i64\n      end",
+			"if ids.empty?\n        return\n      end",
+		} {
+			if !strings.Contains(queriesContent, expected) {
+				t.Errorf("Expected empty slice guard %q, got:\n%s", expected, queriesContent)
+			}
+		}
+
+		if strings.Contains(queriesContent, "raise ArgumentError") {
+			t.Error("Short-circuited queries should not raise")
+		}
+	})
+
+	t.Run("false predicate", func(t *testing.T) {
+		queriesContent := generate(t, EmptySlicesFalsePredicate)
+
+		expected := `expanded = expanded.gsub("/*SLICE:ids*/?", ids.empty? ? "SELECT NULL WHERE 1 = 0" : ids.size.times.map { "?" }.join(", "))`
+		if !strings.Contains(queriesContent, expected) {
+			t.Errorf("Expected empty slices to become an empty subquery:\n%s\nGot:\n%s", expected, queriesContent)
+		}
+
+		if strings.Contains(queriesContent, "ids.empty?\n") {
+			t.Error("False predicate mode should not guard on empty slices")
+		}
+	})
+}
+
+func TestSliceExpansionCache(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "mysql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "ListBooksByAuthorsAndTags",
+				Text: "SELECT id FROM books WHERE author_id IN (/*SLICE:author_ids*/?) AND tag NOT IN (/*SLICE:tags*/?)",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "author_ids", Type: &plugin.Identifier{Name: "int"}, NotNull: true, IsSqlcSlice: true}},
+					{Number: 2, Column: &plugin.Column{Name: "tags", Type: &plugin.Identifier{Name: "varchar"}, NotNull: true, IsSqlcSlice: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	generate := func(t *testing.T, buckets bool) string {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", GeneratorOptions{EmptySlices: EmptySlicesRaise, BucketSliceSizes: buckets}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		return string(resp.Files[0].Contents)
+	}
+
+	// The expanded SQL is cached by slice sizes, with or without buckets
+	cached := []string{
+		"EXPANDED_SQL_LIMIT = 256",
+		"@@expanded_sql = {} of String => String\n    @@expanded_sql_lock = Mutex.new",
+		"private def expanded_sql(key : String, & : -> String) : String\n      @@expanded_sql_lock.synchronize do",
+		"@@expanded_sql.shift if @@expanded_sql.size >= EXPANDED_SQL_LIMIT",
+		"sql = expanded_sql(\"LIST_BOOKS_BY_AUTHORS_AND_TAGS:#{author_ids.size},#{tags.size}\") do\n        expanded = sql\n",
+		`expanded = expanded.gsub("/*SLICE:author_ids*/?", author_ids.size.times.map { "?" }.join(", "))`,
+		`expanded = expanded.gsub("/*SLICE:tags*/?", tags.size.times.map { "?" }.join(", "))`,
+	}
+
+	queriesContent := generate(t, false)
+	for _, expected := range cached {
+		if !strings.Contains(queriesContent, expected) {
+			t.Errorf("Expected %q in generated code, got:\n%s", expected, queriesContent)
+		}
+	}
+	if strings.Contains(queriesContent, "pad_slice") || strings.Contains(queriesContent, "sql = sql.gsub") {
+		t.Errorf("Slices should be expanded through the cache and not padded, got:\n%s", queriesContent)
+	}
+
+	// Bucketing pads the slices first, so the key uses the bucket sizes
+	queriesContent = generate(t, true)
+	for _, expected := range append(cached,
+		"private def pad_slice(values : Array(T)) : Array(T) forall T",
+		"author_ids = pad_slice(author_ids)\n      tags = pad_slice(tags)\n      sql = expanded_sql(",
+	) {
+		if !strings.Contains(queriesContent, expected) {
+			t.Errorf("Expected %q in generated code, got:\n%s", expected, queriesContent)
+		}
+	}
+}
+
+func TestPreparedQueries(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "sqlite",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "GetUser",
+				Text: "SELECT id, name FROM users WHERE id = ?",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "integer"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "integer"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "DeleteUsers",
+				Text: "DELETE FROM users WHERE id IN (/*SLICE:ids*/?)",
+				Cmd:  ":exec",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "ids", Type: &plugin.Identifier{Name: "integer"}, NotNull: true, IsSqlcSlice: true}},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{EmptySlices: EmptySlicesRaise, EmitPreparedQueries: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	queriesContent := string(resp.Files[0].Contents)
+
+	for _, expected := range []string{
+		"class PreparedStatements\n    include DB::QueryMethods(DB::PoolStatement | DB::Statement)",
+		// Statements are kept in a locked LRU cache that closes what it evicts
+		"@lock.synchronize do\n        if statement = @statements.delete(query)\n          return @statements[query] = statement\n        end",
+		"if @statements.size >= LIMIT\n          _, evicted = @statements.shift\n          evicted.close\n        end\n        @statements[query] = @db.prepared(query)",
+		"@statements = PreparedStatements.new(@db)\n      @tx_statements = {} of DB::Connection => PreparedStatements\n      @statements.build(SQL_2_QUERIES[:GET_USER])\n    end",
+		"def close : Nil\n      @statements.close\n      @tx_statements.each_value(&.close)\n      @tx_statements.clear\n    end",
+		// Transactions reuse statements prepared on their connection
+		"statements = conn.same?(@db) ? @statements : (@tx_statements[conn] ||= PreparedStatements.new(conn))\n      Queries.new(tx, statements, @tx_statements)",
+		"@statements.query_one?(",
+		"@statements.exec(sql, args: query_params)",
+	} {
+		if !strings.Contains(queriesContent, expected) {
+			t.Errorf("Expected %q in generated code, got:\n%s", expected, queriesContent)
+		}
+	}
+
+	// Expanded slice SQL can't be prepared before its size is known
+	if strings.Contains(queriesContent, "@statements.build(SQL_2_QUERIES[:DELETE_USERS])") {
+		t.Error("Slice queries should be prepared lazily")
+	}
+	if strings.Contains(queriesContent, "@db.query") || strings.Contains(queriesContent, "@db.exec") {
+		t.Errorf("Prepared queries should not run through @db directly, got:\n%s", queriesContent)
+	}
+}
+
+func TestQueriesAcceptConnectionsAndTransactions(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "CountUsers",
+				Text: "SELECT count(*) FROM users",
+				Cmd:  ":one",
+				Columns: []*plugin.Column{
+					{Name: "count", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{GenerateConnectionManager: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+
+	for _, expected := range []string{
+		"@db : DB::Database | DB::Connection",
+		"def initialize(db : DB::Database | DB::Connection | DB::Transaction)\n      @db = db.is_a?(DB::Transaction) ? db.connection : db\n      @tx = db.as?(DB::Transaction)\n    end",
+		"def with_tx(tx : DB::Transaction) : Queries\n      Queries.new(tx)\n    end",
+	} {
+		if !strings.Contains(files["queries.cr"], expected) {
+			t.Errorf("Expected %q in queries.cr, got:\n%s", expected, files["queries.cr"])
+		}
+	}
+
+	if !strings.Contains(files["database.cr"], "yield queries.with_tx(tx)") {
+		t.Errorf("Expected Database.transaction to bind queries to the transaction, got:\n%s", files["database.cr"])
+	}
+}
+
+func TestEmitInterface(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "GetUser",
+				Text: "SELECT id, name FROM users WHERE id = $1",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true, Table: &plugin.Identifier{Name: "users"}},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true, Table: &plugin.Identifier{Name: "users"}},
+				},
+				InsertIntoTable: &plugin.Identifier{Name: "users"},
+			},
+			{
+				Name:     "ListUsers",
+				Text:     "SELECT id, name FROM users",
+				Cmd:      ":many",
+				Comments: []string{"@cursor batch_size=100"},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true, Table: &plugin.Identifier{Name: "users"}},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true, Table: &plugin.Identifier{Name: "users"}},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{
+		EmitInterface:             true,
+		GenerateConnectionManager: true,
+		GenerateRepositories:      true,
+	}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+
+	for _, expected := range []string{
+		"abstract class Querier",
+		"abstract def get_user(id : Int64) : GetUserRow?",
+		"abstract def list_users() : Array(ListUsersRow)",
+		"abstract def each_list_users(& : ListUsersRow ->) : Nil",
+		"abstract def each_batch_list_users(batch_size : Int32 = 100, & : Array(ListUsersRow) ->) : Nil",
+		"abstract def with_tx(tx : DB::Transaction) : Querier",
+		"class Queries < Querier",
+		"def get_user(id : Int64) : GetUserRow?",
+		"def with_tx(tx : DB::Transaction) : Querier",
+	} {
+		if !strings.Contains(files["queries.cr"], expected) {
+			t.Errorf("Expected %q in queries.cr, got:\n%s", expected, files["queries.cr"])
+		}
+	}
+
+	for _, expected := range []string{"@@queries : Querier?", "def self.queries=(@@queries : Querier?)"} {
+		if !strings.Contains(files["database.cr"], expected) {
+			t.Errorf("Expected %q in database.cr, got:\n%s", expected, files["database.cr"])
+		}
+	}
+
+	for name, content := range files {
+		if strings.HasPrefix(name, "repositories/") && !strings.Contains(content, "def initialize(@queries : Querier)") {
+			t.Errorf("Expected %s to be typed against Querier, got:\n%s", name, content)
+		}
+	}
+}
+
+func TestMockQueries(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "GetUser",
+				Text: "SELECT id, name FROM users WHERE id = $1",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "ListUsersByName",
+				Text: "SELECT id, name FROM users WHERE name = $1",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "name", Type: &plugin.Identifier{Name: "text"}}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "DeleteUsers",
+				Text: "DELETE FROM users",
+				Cmd:  ":execrows",
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{EmitInterface: true, EmitMockQueries: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+
+	mockContent, ok := files["mock_queries.cr"]
+	if !ok {
+		t.Fatal("Expected mock_queries.cr to be generated")
+	}
+
+	for _, expected := range []string{
+		`require "./database"`,
+		"class MockQueries < Querier",
+		"alias Args = NamedTuple(id: Int64) | NamedTuple(name: String?) | NamedTuple()",
+		"def stub_get_user(value : GetUserRow?) : Nil",
+		"def stub_get_user(&block : NamedTuple(id: Int64) -> GetUserRow?) : Nil",
+		"get_user_result(:get_user, {id: id})",
+		"list_users_by_name_result(:each_list_users_by_name, {name: name.as(String?)}).each { |row| yield row }",
+		"delete_users_result(:delete_users, NamedTuple.new)",
+		"Array(ListUsersByNameRow).new",
+		"def with_tx(tx : DB::Transaction) : Querier\n      self\n    end",
+		"def have_called(name : Symbol, args = nil, *, times : Int32? = nil)",
+	} {
+		if !strings.Contains(mockContent, expected) {
+			t.Errorf("Expected %q in mock_queries.cr, got:\n%s", expected, mockContent)
+		}
+	}
+
+	// Specs require the mock themselves
+	if strings.Contains(files["database.cr"], "mock_queries") {
+		t.Error("database.cr should not require the mock")
+	}
+}
+
+func TestMethodsWithDBArgument(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "GetUser",
+				Text: "SELECT id, name FROM users WHERE id = $1",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true, Table: &plugin.Identifier{Name: "users"}},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true, Table: &plugin.Identifier{Name: "users"}},
+				},
+				InsertIntoTable: &plugin.Identifier{Name: "users"},
+			},
+			{
+				Name:     "ListUsers",
+				Text:     "SELECT id, name FROM users",
+				Cmd:      ":many",
+				Comments: []string{"@cursor"},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name: "CountUsersInDb",
+				Text: "SELECT count(*) FROM users WHERE db = $1",
+				Cmd:  ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "db", Type: &plugin.Identifier{Name: "text"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "count", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{
+		EmitMethodsWithDBArgument: true,
+		GenerateConnectionManager: true,
+		GenerateRepositories:      true,
+	}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+
+	for _, expected := range []string{
+		"module Queries\n    extend self",
+		"alias Executor = DB::Database | DB::Connection | DB::Transaction",
+		"def get_user(db : Executor, id : Int64) : GetUserRow?\n      executor(db).query_one?(",
+		"def list_users(db : Executor) : Array(ListUsersRow)",
+		"def each_list_users(db : Executor, & : ListUsersRow ->) : Nil",
+		"def each_batch_list_users(db : Executor, batch_size : Int32 = 1000, & : Array(ListUsersRow) ->) : Nil",
+		// Given a transaction, the cursor is declared in a savepoint of it
+		"db.transaction do |tx|",
+		// A parameter can't take the name of the leading db argument
+		"def count_users_in_db(db : Executor, db_2 : String) : Int64?",
+	} {
+		if !strings.Contains(files["queries.cr"], expected) {
+			t.Errorf("Expected %q in queries.cr, got:\n%s", expected, files["queries.cr"])
+		}
+	}
+	for _, unexpected := range []string{"@db", "def initialize", "with_tx", "executor(db).transaction"} {
+		if strings.Contains(files["queries.cr"], unexpected) {
+			t.Errorf("Did not expect %q in queries.cr, got:\n%s", unexpected, files["queries.cr"])
+		}
+	}
+
+	if strings.Contains(files["database.cr"], "Queries.new") {
+		t.Errorf("Database should not build Queries instances, got:\n%s", files["database.cr"])
+	}
+
+	repo := files["repositories/users_repository.cr"]
+	for _, expected := range []string{
+		"Queries.get_user(Database.connection, id: id)",
+		"def initialize(@db : Queries::Executor)",
+		"Queries.get_user(@db, id: id)",
+		"yield Transaction.new(tx)",
+	} {
+		if !strings.Contains(repo, expected) {
+			t.Errorf("Expected %q in users repository, got:\n%s", expected, repo)
+		}
+	}
+
+	// Methods of the module are called on it, not on an instance
+	limit := int32(0)
+	resp, err = NewGenerator(req, "db", GeneratorOptions{
+		EmitMethodsWithDBArgument: true,
+		QueryParameterLimit:       &limit,
+	}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if queries := string(resp.Files[0].Contents); !strings.Contains(queries, "# Parameters for Queries.get_user\n") {
+		t.Errorf("Expected params struct doc to reference Queries.get_user, got:\n%s", queries)
+	}
+}
+
+func TestSplitQueriesByFile(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{
+				Name:     "GetAuthor",
+				Filename: "authors.sql",
+				Text:     "SELECT id, name FROM authors WHERE id = $1",
+				Cmd:      ":one",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+				},
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+			{
+				Name:     "DeleteBook",
+				Filename: "books.sql",
+				Text:     "DELETE FROM books WHERE id = $1",
+				Cmd:      ":exec",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}},
+				},
+			},
+			{
+				Name:     "ListAuthors",
+				Filename: "authors.sql",
+				Text:     "SELECT id, name FROM authors",
+				Cmd:      ":many",
+				Columns: []*plugin.Column{
+					{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+					{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	generate := func(t *testing.T, options GeneratorOptions) map[string]string {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", options).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		files := make(map[string]string)
+		for _, file := range resp.Files {
+			files[file.Name] = string(file.Contents)
+		}
+		return files
+	}
+
+	t.Run("shared class", func(t *testing.T) {
+		files := generate(t, GeneratorOptions{SplitQueriesByFile: true, EmitPreparedQueries: true})
+
+		shared := files["queries.cr"]
+		for _, expected := range []string{
+			"class Queries\n    # Transactions run on their connection",
+			"@statements.build(SQL_AUTHORS_QUERIES[:GET_AUTHOR])",
+			"@statements.build(SQL_BOOKS_QUERIES[:DELETE_BOOK])",
+		} {
+			if !strings.Contains(shared, expected) {
+				t.Errorf("Expected %q in queries.cr, got:\n%s", expected, shared)
+			}
+		}
+		if strings.Contains(shared, "def get_author") {
+			t.Errorf("queries.cr should not contain query methods, got:\n%s", shared)
+		}
+
+		authors := files["queries/authors.cr"]
+		for _, expected := range []string{
+			"  class Queries\n    SQL_AUTHORS_QUERIES = {",
+			"def get_author(id : Int64) : GetAuthorRow?",
+			"def list_authors() : Array(ListAuthorsRow)",
+		} {
+			if !strings.Contains(authors, expected) {
+				t.Errorf("Expected %q in queries/authors.cr, got:\n%s", expected, authors)
+			}
+		}
+		if strings.Contains(authors, "def initialize") || strings.Contains(authors, "delete_book") {
+			t.Errorf("queries/authors.cr should only contain its own methods, got:\n%s", authors)
+		}
+
+		if !strings.Contains(files["queries/books.cr"], "def delete_book(id : Int64) : Nil") {
+			t.Errorf("Expected delete_book in queries/books.cr, got:\n%s", files["queries/books.cr"])
+		}
+
+		expected := "require \"./queries\"\nrequire \"./queries/authors\"\nrequire \"./queries/books\""
+		if !strings.Contains(files["database.cr"], expected) {
+			t.Errorf("Expected database.cr to require every query file, got:\n%s", files["database.cr"])
+		}
+	})
+
+	t.Run("class per file", func(t *testing.T) {
+		files := generate(t, GeneratorOptions{SplitQueriesByFile: true, QueryClassPerFile: true, GenerateConnectionManager: true})
+
+		// Nothing is shared without Unset or prepared statements
+		if _, ok := files["queries.cr"]; ok {
+			t.Error("Did not expect queries.cr without shared definitions")
+		}
+
+		for name, expected := range map[string][]string{
+			"queries/authors.cr": {"class AuthorsQueries", "def with_tx(tx : DB::Transaction) : AuthorsQueries", "def get_author(id : Int64)"},
+			"queries/books.cr":   {"class BooksQueries", "def initialize(db : DB::Database | DB::Connection | DB::Transaction)", "def delete_book(id : Int64)"},
+		} {
+			for _, e := range expected {
+				if !strings.Contains(files[name], e) {
+					t.Errorf("Expected %q in %s, got:\n%s", e, name, files[name])
+				}
+			}
+			if strings.Contains(files[name], "# Transactions run on their connection") {
+				t.Errorf("Did not expect the shared executor comment in %s, got:\n%s", name, files[name])
+			}
+		}
+
+		database := files["database.cr"]
+		if strings.Contains(database, "require \"./queries\"\n") || strings.Contains(database, "Queries.new") {
+			t.Errorf("database.cr should not refer to a single Queries class, got:\n%s", database)
+		}
+	})
+
+	fileReq := func(filenames ...string) *plugin.GenerateRequest {
+		r := &plugin.GenerateRequest{Settings: &plugin.Settings{Engine: "postgresql"}}
+		for i, filename := range filenames {
+			r.Queries = append(r.Queries, &plugin.Query{
+				Name:     "Query" + string(rune('A'+i)),
+				Filename: filename,
+				Text:     "DELETE FROM books",
+				Cmd:      ":exec",
+			})
+		}
+		return r
+	}
+
+	t.Run("names that are not identifiers", func(t *testing.T) {
+		resp, err := NewGenerator(fileReq("2024_fixes.sql", "book-lists.sql"), "db", GeneratorOptions{SplitQueriesByFile: true, QueryClassPerFile: true}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		files := make(map[string]string)
+		for _, file := range resp.Files {
+			files[file.Name] = string(file.Contents)
+		}
+
+		for name, expected := range map[string][]string{
+			"queries/file_2024_fixes.cr": {"class File2024FixesQueries", "SQL_FILE_2024_FIXES_QUERIES = {"},
+			"queries/book_lists.cr":      {"class BookListsQueries", "SQL_BOOK_LISTS_QUERIES = {"},
+		} {
+			for _, e := range expected {
+				if !strings.Contains(files[name], e) {
+					t.Errorf("Expected %q in %s, got:\n%s", e, name, files[name])
+				}
+			}
+		}
+	})
+
+	t.Run("same base name in different directories", func(t *testing.T) {
+		_, err := NewGenerator(fileReq("a/users.sql", "b/users.sql"), "db", GeneratorOptions{SplitQueriesByFile: true}).Generate(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "users.cr") {
+			t.Errorf("Expected an error about users.cr, got %v", err)
+		}
+	})
+}
+
+func TestModelFilesAndOutputNames(t *testing.T) {
+	table := func(name string) *plugin.Table {
+		return &plugin.Table{
+			Rel: &plugin.Identifier{Name: name},
+			Columns: []*plugin.Column{
+				{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+			},
+		}
+	}
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			Schemas: []*plugin.Schema{
+				{Name: "public", Tables: []*plugin.Table{table("authors"), table("book_reviews")}},
+			},
+		},
+		Queries: []*plugin.Query{
+			{
+				Name:     "CountAuthors",
+				Filename: "authors.sql",
+				Text:     "SELECT count(*) FROM authors",
+				Cmd:      ":one",
+				Columns: []*plugin.Column{
+					{Name: "count", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{
+		SplitModelsByFile:  true,
+		SplitQueriesByFile: true,
+		EmitInterface:      true,
+		EmitMockQueries:    true,
+		ModelsFileName:     "records.cr",
+		QueriesFileName:    "sql.cr",
+		DatabaseFileName:   "app_db.cr",
+	}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+
+	for name, expected := range map[string]string{
+		"records/author.cr":      "struct Author\n",
+		"records/book_review.cr": "struct BookReview\n",
+		"sql.cr":                 "abstract class Querier",
+		"sql/authors.cr":         "def count_authors() : Int64?",
+		"mock_queries.cr":        "require \"./app_db\"",
+	} {
+		if !strings.Contains(files[name], expected) {
+			t.Errorf("Expected %q in %s, got:\n%s", expected, name, files[name])
+		}
+	}
+	if strings.Contains(files["records/author.cr"], "BookReview") {
+		t.Errorf("records/author.cr should only contain its own model, got:\n%s", files["records/author.cr"])
+	}
+
+	expected := "require \"./records/author\"\nrequire \"./records/book_review\"\nrequire \"./records/count_authors_row\"\nrequire \"./sql\"\nrequire \"./sql/authors\""
+	if !strings.Contains(files["app_db.cr"], expected) {
+		t.Errorf("Expected app_db.cr to require every generated file, got:\n%s", files["app_db.cr"])
+	}
+
+	// Two outputs sharing a name would overwrite each other
+	_, err = NewGenerator(req, "db", GeneratorOptions{QueriesFileName: "models.cr"}).Generate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "models.cr") {
+		t.Errorf("Expected an error about models.cr, got %v", err)
+	}
+}
+
+func TestModelDocComments(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			DefaultSchema: "public",
+			Schemas: []*plugin.Schema{
+				{
+					Name:    "public",
+					Comment: "Bookstore schema.",
+					Enums: []*plugin.Enum{
+						{Name: "book_status", Vals: []string{"draft", "published"}, Comment: "Publication state of a book."},
+					},
+					Tables: []*plugin.Table{
+						{
+							Rel:     &plugin.Identifier{Name: "books"},
+							Comment: "Books in the catalog.\n\nOne row per edition.",
+							Columns: []*plugin.Column{
+								{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+								{Name: "status", Type: &plugin.Identifier{Name: "book_status"}, NotNull: true, Comment: "Where the book is in the pipeline."},
+								{Name: "isbn", Type: &plugin.Identifier{Name: "text"}, Comment: "ISBN-13, if assigned."},
+							},
+						},
+						{
+							Rel: &plugin.Identifier{Name: "authors"},
+							Columns: []*plugin.Column{
+								{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{EmitDBTags: true, EmitJSONTags: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	var models string
+	for _, file := range resp.Files {
+		if file.Name == "models.cr" {
+			models = string(file.Contents)
+		}
+	}
+
+	for _, expected := range []string{
+		"# Bookstore schema.\nmodule Db\n",
+		"  # Books in the catalog.\n  #\n  # One row per edition.\n  struct Book\n",
+		"    # Where the book is in the pipeline.\n    #\n    # `book_status`: Publication state of a book.\n    @[JSON::Field(key: \"status\")]\n    getter status : String\n",
+		"    # ISBN-13, if assigned.\n    @[JSON::Field(key: \"isbn\")]\n    getter isbn : String?\n",
+		"    @[JSON::Field(key: \"id\")]\n    getter id : Int64\n",
+	} {
+		if !strings.Contains(models, expected) {
+			t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+		}
+	}
+
+	// Split models document the module once, in the first file
+	resp, err = NewGenerator(req, "db", GeneratorOptions{SplitModelsByFile: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+	if !strings.Contains(files["models/author.cr"], "# Bookstore schema.\nmodule Db\n") {
+		t.Errorf("Expected the module doc in models/author.cr, got:\n%s", files["models/author.cr"])
+	}
+	if strings.Contains(files["models/book.cr"], "Bookstore schema.") {
+		t.Errorf("Did not expect the module doc in models/book.cr, got:\n%s", files["models/book.cr"])
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	columns := []*plugin.Column{
+		{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+		{Name: "end", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true},
+		{Name: "type", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+		{Name: "hash", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+	}
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			Schemas: []*plugin.Schema{
+				{Name: "public", Tables: []*plugin.Table{{Rel: &plugin.Identifier{Name: "events"}, Columns: columns}}},
+			},
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "ListEventsByType",
+				Text: "SELECT id, \"end\", type, hash FROM events WHERE type = $1 AND \"end\" < $2",
+				Cmd:  ":many",
+				Params: []*plugin.Parameter{
+					{Number: 1, Column: &plugin.Column{Name: "type", Type: &plugin.Identifier{Name: "text"}, NotNull: true}},
+					{Number: 2, Column: &plugin.Column{Name: "end", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true}},
+				},
+				Columns: columns,
+			},
+		},
+	}
+
+	generate := func(t *testing.T, strategy string) map[string]string {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", GeneratorOptions{ReservedNameStrategy: strategy}).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		files := make(map[string]string)
+		for _, file := range resp.Files {
+			files[file.Name] = string(file.Contents)
+		}
+		return files
+	}
+
+	tests := []struct {
+		strategy string
+		models   []string
+		queries  []string
+	}{
+		{
+			strategy: ReservedNameSuffix,
+			models: []string{
+				"    @[DB::Field(key: \"end\")]\n    getter end_ : Time\n",
+				"    @[DB::Field(key: \"type\")]\n    getter type_ : String\n",
+				"    @[DB::Field(key: \"hash\")]\n    getter hash_ : String\n",
+				"    getter id : Int64\n",
+			},
+			queries: []string{"def list_events_by_type(type_ : String, end_ : Time) : Array(Event)"},
+		},
+		{
+			strategy: ReservedNamePrefix,
+			models:   []string{"    @[DB::Field(key: \"end\")]\n    getter _end : Time\n"},
+			queries:  []string{"def list_events_by_type(_type : String, _end : Time) : Array(Event)"},
+		},
+		{
+			// Method names are kept, but keywords are still escaped
+			strategy: ReservedNameKeep,
+			models: []string{
+				"    @[DB::Field(key: \"end\")]\n    getter end_ : Time\n",
+				"    @[DB::Field(key: \"type\")]\n    getter type_ : String\n",
+				"    getter type_ : String\n    getter hash : String\n",
+			},
+			queries: []string{"def list_events_by_type(type_ : String, end_ : Time) : Array(Event)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			files := generate(t, tt.strategy)
+			for _, expected := range tt.models {
+				if !strings.Contains(files["models.cr"], expected) {
+					t.Errorf("Expected %q in models.cr, got:\n%s", expected, files["models.cr"])
+				}
+			}
+			for _, expected := range tt.queries {
+				if !strings.Contains(files["queries.cr"], expected) {
+					t.Errorf("Expected %q in queries.cr, got:\n%s", expected, files["queries.cr"])
+				}
+			}
+		})
+	}
+}
+
+func TestFieldNameCollisions(t *testing.T) {
+	generate := func(t *testing.T, req *plugin.GenerateRequest) (string, error) {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+		if err != nil {
+			return "", err
+		}
+		for _, file := range resp.Files {
+			if file.Name == "models.cr" {
+				return string(file.Contents), nil
+			}
+		}
+		return "", nil
+	}
+	text := func(name string) *plugin.Column {
+		return &plugin.Column{Name: name, Type: &plugin.Identifier{Name: "text"}, NotNull: true}
+	}
+	from := func(table string, col *plugin.Column) *plugin.Column {
+		col.Table = &plugin.Identifier{Name: table}
+		return col
+	}
+
+	catalog := &plugin.Catalog{
+		Schemas: []*plugin.Schema{
+			{Name: "public", Tables: []*plugin.Table{
+				{Rel: &plugin.Identifier{Name: "authors"}, Columns: []*plugin.Column{text("id")}},
+			}},
+		},
+	}
+
+	t.Run("case conversion", func(t *testing.T) {
+		models, err := generate(t, &plugin.GenerateRequest{
+			Settings: &plugin.Settings{Engine: "postgresql"},
+			Catalog: &plugin.Catalog{
+				Schemas: []*plugin.Schema{
+					{Name: "public", Tables: []*plugin.Table{
+						{Rel: &plugin.Identifier{Name: "users"}, Columns: []*plugin.Column{text("userId"), text("user_id"), text("UserId")}},
+					}},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		for _, expected := range []string{
+			"    @[DB::Field(key: \"userId\")]\n    getter user_id_2 : String\n",
+			"    getter user_id : String\n",
+			"    @[DB::Field(key: \"UserId\")]\n    getter user_id_3 : String\n",
+		} {
+			if !strings.Contains(models, expected) {
+				t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+			}
+		}
+	})
+
+	t.Run("joined tables", func(t *testing.T) {
+		models, err := generate(t, &plugin.GenerateRequest{
+			Settings: &plugin.Settings{Engine: "postgresql"},
+			Catalog:  catalog,
+			Queries: []*plugin.Query{
+				{
+					Name:    "ListTitles",
+					Text:    "SELECT a.name, b.\"Name\" FROM authors a JOIN books b ON b.author_id = a.id",
+					Cmd:     ":many",
+					Columns: []*plugin.Column{from("authors", text("name")), from("books", text("Name"))},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		for _, expected := range []string{
+			"    getter name : String\n",
+			"    @[DB::Field(key: \"Name\")]\n    getter book_name : String\n",
+		} {
+			if !strings.Contains(models, expected) {
+				t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+			}
+		}
+	})
+
+	t.Run("same column name", func(t *testing.T) {
+		query := &plugin.Query{
+			Name:    "ListPairs",
+			Text:    "SELECT a.id, b.id FROM authors a JOIN books b ON b.author_id = a.id",
+			Cmd:     ":many",
+			Columns: []*plugin.Column{from("authors", text("id")), from("books", text("id"))},
+		}
+		req := &plugin.GenerateRequest{
+			Settings: &plugin.Settings{Engine: "postgresql"},
+			Catalog:  catalog,
+			Queries:  []*plugin.Query{query},
+		}
+		_, err := generate(t, req)
+		if err == nil || !strings.Contains(err.Error(), "query ListPairs: more than one column is named \"id\"") {
+			t.Errorf("Expected an error about the duplicate id column, got %v", err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "alias all but one of them") {
+			t.Errorf("Expected the error to suggest an alias, got %v", err)
+		}
+
+		// The struct lookup reports the collision too, instead of naming a
+		// struct that can't be read
+		if _, err := NewGenerator(req, "db", GeneratorOptions{}).getStructNameForQuery(query); err == nil {
+			t.Error("Expected getStructNameForQuery to return an error")
+		}
+	})
+}
+
+func TestRenameAndExactTableNames(t *testing.T) {
+	authors := &plugin.Identifier{Name: "authors"}
+	authorColumns := []*plugin.Column{
+		{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true, Table: authors},
+		{Name: "spotify_url", Type: &plugin.Identifier{Name: "text"}, NotNull: true, Table: authors},
+		{Name: "status", Type: &plugin.Identifier{Name: "text"}, NotNull: true, Table: authors},
+	}
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			Schemas: []*plugin.Schema{
+				{Name: "public", Tables: []*plugin.Table{
+					{Rel: &plugin.Identifier{Name: "authors"}, Columns: authorColumns},
+					{Rel: &plugin.Identifier{Name: "book_reviews"}, Columns: []*plugin.Column{
+						{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+					}},
+					{Rel: &plugin.Identifier{Name: "status"}, Columns: []*plugin.Column{
+						{Name: "code", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+					}},
+				}},
+			},
+		},
+		Queries: []*plugin.Query{
+			{
+				Name:    "ListAuthors",
+				Text:    "SELECT id, spotify_url, status FROM authors",
+				Cmd:     ":many",
+				Columns: authorColumns,
+			},
+			{
+				Name: "ListReviewAuthors",
+				Text: "SELECT sqlc.embed(authors), book_reviews.id FROM book_reviews JOIN authors ON authors.id = book_reviews.author_id",
+				Cmd:  ":many",
+				Columns: []*plugin.Column{
+					{Name: "authors", EmbedTable: &plugin.Identifier{Name: "authors"}},
+					{Name: "review_id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	generate := func(t *testing.T, options GeneratorOptions) map[string]string {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", options).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		files := make(map[string]string)
+		for _, file := range resp.Files {
+			files[file.Name] = string(file.Contents)
+		}
+		return files
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		files := generate(t, GeneratorOptions{
+			GenerateRepositories: true,
+			Rename: map[string]string{
+				"authors":             "Writer",
+				"authors.spotify_url": "spotify_link",
+				"status":              "AccountStatus",
+			},
+		})
+
+		for name, expected := range map[string][]string{
+			"models.cr": {
+				"  struct Writer\n",
+				"    @[DB::Field(key: \"spotify_url\")]\n    getter spotify_link : String\n",
+				// Renaming the status table leaves the status column alone
+				"  struct AccountStatus\n",
+				"    getter status : String\n",
+				"    getter writer : Writer\n",
+				"  struct BookReview\n",
+			},
+			"queries.cr":                          {"def list_authors() : Array(Writer)"},
+			"repositories/authors_repository.cr": {"module WriterRepository"},
+		} {
+			for _, e := range expected {
+				if !strings.Contains(files[name], e) {
+					t.Errorf("Expected %q in %s, got:\n%s", e, name, files[name])
+				}
+			}
+		}
+	})
+
+	t.Run("exact table names", func(t *testing.T) {
+		files := generate(t, GeneratorOptions{EmitExactTableNames: true})
+
+		for _, expected := range []string{"  struct Authors\n", "  struct BookReviews\n", "    getter authors : Authors\n"} {
+			if !strings.Contains(files["models.cr"], expected) {
+				t.Errorf("Expected %q in models.cr, got:\n%s", expected, files["models.cr"])
+			}
+		}
+		if !strings.Contains(files["queries.cr"], "def list_authors() : Array(Authors)") {
+			t.Errorf("Expected list_authors to reuse Authors, got:\n%s", files["queries.cr"])
+		}
+	})
+}
+
+func TestRepositoryMethodNames(t *testing.T) {
+	id := &plugin.Parameter{Number: 1, Column: &plugin.Column{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}}
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Queries: []*plugin.Query{
+			{Name: "GetStatus", Text: "SELECT id FROM statuses WHERE id = $1", Cmd: ":one", Params: []*plugin.Parameter{id}},
+			{Name: "StatusLabels", Text: "SELECT id FROM statuses", Cmd: ":many"},
+			{Name: "DeleteCategory", Text: "DELETE FROM categories WHERE id = $1", Cmd: ":exec", Params: []*plugin.Parameter{id}},
+			{Name: "GetPerson", Text: "SELECT id FROM people WHERE id = $1", Cmd: ":one", Params: []*plugin.Parameter{id}},
+		},
+	}
+	for _, q := range req.Queries {
+		q.Columns = []*plugin.Column{{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true}}
+	}
+	req.Queries[2].Columns = nil
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{GenerateRepositories: true}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	files := make(map[string]string)
+	for _, file := range resp.Files {
+		files[file.Name] = string(file.Contents)
+	}
+
+	// Table names are singularized like struct names, irregular plurals too
+	for name, expected := range map[string][]string{
+		"repositories/statuses_repository.cr":   {"def find(id : Int64)", "def labels()"},
+		"repositories/categories_repository.cr": {"def delete(id : Int64)"},
+		"repositories/people_repository.cr":     {"def find(id : Int64)"},
+	} {
+		for _, e := range expected {
+			if !strings.Contains(files[name], e) {
+				t.Errorf("Expected %q in %s, got:\n%s", e, name, files[name])
+			}
+		}
+	}
+}
+
+func TestModelConstructors(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			Schemas: []*plugin.Schema{
+				{Name: "public", Tables: []*plugin.Table{
+					{Rel: &plugin.Identifier{Name: "events"}, Columns: []*plugin.Column{
+						{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+						{Name: "end", Type: &plugin.Identifier{Name: "timestamptz"}, NotNull: true},
+						{Name: "tags", Type: &plugin.Identifier{Name: "text"}, NotNull: true, IsArray: true},
+						{Name: "note", Type: &plugin.Identifier{Name: "text"}},
+					}},
+				}},
+			},
+		},
+		Queries: []*plugin.Query{
+			{
+				Name: "CountEventsByDay",
+				Text: "SELECT date_trunc('day', \"end\") AS day, count(*) FROM events GROUP BY 1",
+				Cmd:  ":many",
+				Columns: []*plugin.Column{
+					{Name: "day", Type: &plugin.Identifier{Name: "timestamptz"}},
+					{Name: "count", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+				},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	var models string
+	for _, file := range resp.Files {
+		if file.Name == "models.cr" {
+			models = string(file.Contents)
+		}
+	}
+
+	for _, expected := range []string{
+		"    getter note : String?\n\n    def initialize(*, @id : Int64, @end_ : Time, @tags : Array(String), @note : String? = nil)\n    end\n",
+		"    def initialize(*, @day : Time? = nil, @count : Int64)\n    end\n",
+	} {
+		if !strings.Contains(models, expected) {
+			t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+		}
+	}
+
+	// Structs without fields get neither a constructor nor helpers
+	var buf bytes.Buffer
+	if err := modelsTemplate.Execute(&buf, templateData{Package: "db", Structs: []*crystalStruct{{Name: "Heartbeat"}}}); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if expected := "  struct Heartbeat\n    include DB::Serializable\n  end\n"; !strings.Contains(buf.String(), expected) {
+		t.Errorf("Expected %q in models.cr, got:\n%s", expected, buf.String())
+	}
+}
+
+func TestModelValueHelpers(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			Schemas: []*plugin.Schema{
+				{Name: "public", Tables: []*plugin.Table{
+					{Rel: &plugin.Identifier{Name: "authors"}, Columns: []*plugin.Column{
+						{Name: "id", Type: &plugin.Identifier{Name: "int8"}, NotNull: true},
+						{Name: "bio", Type: &plugin.Identifier{Name: "text"}},
+						{Name: "to_h", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+					}},
+				}},
+			},
+		},
+	}
+
+	resp, err := NewGenerator(req, "db", GeneratorOptions{}).Generate(context.Background())
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	var models string
+	for _, file := range resp.Files {
+		if file.Name == "models.cr" {
+			models = string(file.Contents)
+		}
+	}
+
+	for _, expected := range []string{
+		"    @[DB::Field(key: \"to_h\")]\n    getter to_h_ : String\n",
+		"    def_equals_and_hash @id, @bio, @to_h_\n",
+		"    def copy_with(*, id : Int64 = @id, bio : String? = @bio, to_h_ : String = @to_h_) : self\n      self.class.new(id: id, bio: bio, to_h_: to_h_)\n    end\n",
+		"    def to_h\n      {\"id\" => @id, \"bio\" => @bio, \"to_h_\" => @to_h_}\n    end\n",
+		"    def to_named_tuple\n      {id: @id, bio: @bio, to_h_: @to_h_}\n    end\n",
+	} {
+		if !strings.Contains(models, expected) {
+			t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+		}
+	}
+}
+
+func TestClassesAndProperties(t *testing.T) {
+	req := &plugin.GenerateRequest{
+		Settings: &plugin.Settings{
+			Engine: "postgresql",
+		},
+		Catalog: &plugin.Catalog{
+			Schemas: []*plugin.Schema{
+				{Name: "public", Tables: []*plugin.Table{
+					{Rel: &plugin.Identifier{Name: "authors"}, Columns: []*plugin.Column{
+						{Name: "name", Type: &plugin.Identifier{Name: "text"}, NotNull: true},
+						{Name: "bio", Type: &plugin.Identifier{Name: "text"}},
+						{Name: "active", Type: &plugin.Identifier{Name: "bool"}, NotNull: true},
+					}},
+				}},
+			},
+		},
+	}
+
+	generate := func(t *testing.T, options GeneratorOptions) string {
+		t.Helper()
+		resp, err := NewGenerator(req, "db", options).Generate(context.Background())
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		for _, file := range resp.Files {
+			if file.Name == "models.cr" {
+				return string(file.Contents)
+			}
+		}
+		return ""
+	}
+
+	models := generate(t, GeneratorOptions{EmitClasses: true, EmitProperties: true, EmitBooleanQuestionGetters: true})
+	for _, expected := range []string{
+		"  class Author\n",
+		"    property name : String\n",
+		"    property bio : String?\n",
+		"    property? active : Bool\n",
+	} {
+		if !strings.Contains(models, expected) {
+			t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+		}
+	}
+	if strings.Contains(models, "getter") {
+		t.Errorf("Did not expect getters with emit_properties, got:\n%s", models)
+	}
+	// A hash that changes with the fields would break Hash keys
+	if strings.Contains(models, "def_equals_and_hash") {
+		t.Errorf("Did not expect value equality with emit_properties, got:\n%s", models)
+	}
+	if !strings.Contains(models, "    end\n\n    # Returns a copy with the given fields changed\n") {
+		t.Errorf("Expected copy_with right after the constructor, got:\n%s", models)
+	}
+
+	// Classes with getters can't change, so they keep value equality
+	models = generate(t, GeneratorOptions{EmitClasses: true})
+	if !strings.Contains(models, "  class Author\n") || !strings.Contains(models, "def_equals_and_hash @name, @bio, @active") {
+		t.Errorf("Expected a class with value equality, got:\n%s", models)
+	}
+
+	models = generate(t, GeneratorOptions{})
+	for _, expected := range []string{"  struct Author\n", "    getter bio : String?\n"} {
+		if !strings.Contains(models, expected) {
+			t.Errorf("Expected %q in models.cr, got:\n%s", expected, models)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package crystal
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Inflector turns plural table names into singular struct names. Words are
+// checked against the uncountable words first, then the irregular plurals,
+// then the suffix rules in order until one matches.
+type Inflector struct {
+	uncountables map[string]bool
+	irregulars   map[string]string // plural -> singular
+	rules        []inflectionRule
+}
+
+type inflectionRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Default singularization rules, most specific first
+var defaultSingularRules = [][2]string{
+	{`(database)s$`, "${1}"},
+	{`(quiz)zes$`, "${1}"},
+	{`(matr)ices$`, "${1}ix"},
+	{`(vert|ind)ices$`, "${1}ex"},
+	{`(^|_)(ox)en$`, "${1}${2}"},
+	{`(alias|status)(es)?$`, "${1}"},
+	{`(octop|vir)(us|i)$`, "${1}us"},
+	{`(^|_)(a)x[ie]s$`, "${1}${2}xis"},
+	{`(cris|test)(is|es)$`, "${1}is"},
+	{`(shoe)s$`, "${1}"},
+	{`(o)es$`, "${1}"},
+	{`(bus)(es)?$`, "${1}"},
+	{`(^|_)(m|l)ice$`, "${1}${2}ouse"},
+	{`(x|ch|ss|sh)es$`, "${1}"},
+	{`(m)ovies$`, "${1}ovie"},
+	{`(s)eries$`, "${1}eries"},
+	{`([^aeiouy]|qu)ies$`, "${1}y"},
+	{`([lr])ves$`, "${1}f"},
+	{`(tive)s$`, "${1}"},
+	{`(hive)s$`, "${1}"},
+	{`([^f])ves$`, "${1}fe"},
+	{`((a)naly|(b)a|(d)iagno|(p)arenthe|(p)rogno|(s)ynop|(t)he)(sis|ses)$`, "${1}sis"},
+	{`(^|_)(analy)(sis|ses)$`, "${1}${2}sis"},
+	{`([ti])a$`, "${1}um"},
+	{`(n)ews$`, "${1}ews"},
+	{`(ss)$`, "${1}"},
+	{`s$`, ""},
+}
+
+var defaultIrregulars = map[string]string{
+	"children":  "child",
+	"people":    "person",
+	"men":       "man",
+	"women":     "woman",
+	"feet":      "foot",
+	"teeth":     "tooth",
+	"geese":     "goose",
+	"dice":      "die",
+	"sexes":     "sex",
+	"moves":     "move",
+	"zombies":   "zombie",
+	"criteria":  "criterion",
+	"phenomena": "phenomenon",
+}
+
+var defaultUncountables = []string{
+	"data", "equipment", "fish", "information", "jeans", "metadata",
+	"money", "news", "police", "rice", "series", "sheep", "species",
+}
+
+// NewInflector returns an inflector with the default English rules
+func NewInflector() *Inflector {
+	inf := &Inflector{
+		uncountables: make(map[string]bool),
+		irregulars:   make(map[string]string),
+	}
+	for _, word := range defaultUncountables {
+		inf.AddUncountable(word)
+	}
+	for plural, singular := range defaultIrregulars {
+		inf.AddIrregular(plural, singular)
+	}
+	for i := len(defaultSingularRules) - 1; i >= 0; i-- {
+		rule := defaultSingularRules[i]
+		if err := inf.AddRule(rule[0], rule[1]); err != nil {
+			panic(err)
+		}
+	}
+	return inf
+}
+
+// AddUncountable adds a word that is left as it is
+func (inf *Inflector) AddUncountable(word string) {
+	inf.uncountables[strings.ToLower(word)] = true
+}
+
+// AddIrregular adds a plural whose singular doesn't follow any rule
+func (inf *Inflector) AddIrregular(plural, singular string) {
+	inf.irregulars[strings.ToLower(plural)] = strings.ToLower(singular)
+}
+
+// AddRule adds a suffix rule that is checked before every rule added so
+// far. The pattern is matched case-insensitively, and the replacement can
+// refer to its groups as ${1}, ${2}, ...
+func (inf *Inflector) AddRule(pattern, replacement string) error {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return err
+	}
+	inf.rules = append([]inflectionRule{{pattern: re, replacement: replacement}}, inf.rules...)
+	return nil
+}
+
+// Singularize returns the singular form of a word. Uncountable words and
+// irregular plurals also match as the last part of a snake_case name, so
+// user_data and team_people work too.
+func (inf *Inflector) Singularize(word string) string {
+	if len(word) <= 1 {
+		return word
+	}
+
+	lower := strings.ToLower(word)
+	prefix, last := "", lower
+	if i := strings.LastIndex(lower, "_"); i >= 0 {
+		prefix, last = word[:i+1], lower[i+1:]
+	}
+
+	if inf.uncountables[last] {
+		return word
+	}
+
+	if singular, ok := inf.irregulars[last]; ok {
+		// Preserve original casing
+		rest := word[len(prefix):]
+		if strings.ToUpper(rest) == rest {
+			singular = strings.ToUpper(singular)
+		} else if rest[0] >= 'A' && rest[0] <= 'Z' {
+			singular = strings.ToUpper(singular[:1]) + singular[1:]
+		}
+		return prefix + singular
+	}
+
+	for _, rule := range inf.rules {
+		if rule.pattern.MatchString(word) {
+			return rule.pattern.ReplaceAllString(word, rule.replacement)
+		}
+	}
+	return word
+}
@@ -0,0 +1,87 @@
+package crystal
+
+import "testing"
+
+func TestInflectorSingularize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"statuses", "status"},
+		{"analyses", "analysis"},
+		{"movies", "movie"},
+		{"news", "news"},
+		{"series", "series"},
+		{"data", "data"},
+		{"user_data", "user_data"},
+		{"team_people", "team_person"},
+		{"People", "Person"},
+		{"addresses", "address"},
+		{"address", "address"},
+		{"class", "class"},
+		{"wolves", "wolf"},
+		{"categories", "category"},
+		{"matrices", "matrix"},
+		{"indices", "index"},
+		{"quizzes", "quiz"},
+		{"octopi", "octopus"},
+		{"order_items", "order_item"},
+		{"USERS", "USER"},
+		{"criteria", "criterion"},
+		{"search_criteria", "search_criterion"},
+		{"phenomena", "phenomenon"},
+		{"oxen", "ox"},
+		{"pack_oxen", "pack_ox"},
+		{"boxen", "boxen"},
+		{"axes", "axis"},
+		{"chart_axes", "chart_axis"},
+		{"taxes", "tax"},
+	}
+
+	inf := NewInflector()
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := inf.Singularize(tt.input)
+			if result != tt.expected {
+				t.Errorf("Singularize(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestInflectorCustomRules(t *testing.T) {
+	inf := NewInflector()
+	inf.AddUncountable("feedback")
+	inf.AddIrregular("alumni", "alumnus")
+	if err := inf.AddRule(`(ca)cti$`, "${1}ctus"); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"feedback", "feedback"},
+		{"alumni", "alumnus"},
+		{"cacti", "cactus"},
+		{"users", "user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := inf.Singularize(tt.input)
+			if result != tt.expected {
+				t.Errorf("Singularize(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	if err := inf.AddRule(`(`, ""); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+
+	// Rules are per inflector, so the defaults are unchanged
+	if result := singularize("cacti"); result != "cacti" {
+		t.Errorf("singularize(%q) = %q, want %q", "cacti", result, "cacti")
+	}
+}
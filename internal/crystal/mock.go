@@ -0,0 +1,92 @@
+package crystal
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/sqlc-dev/plugin-sdk-go/plugin"
+)
+
+// generateMockQueries generates mock_queries.cr, an in-memory Querier for
+// specs that records calls and returns stubbed values
+func (g *Generator) generateMockQueries(queries []crystalQuery) (*plugin.File, error) {
+	var buf bytes.Buffer
+	err := mockQueriesTemplate.Execute(&buf, templateData{
+		Package:  g.pkg,
+		Queries:  queries,
+		Requires: []string{requirePath(g.options.DatabaseFileName)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &plugin.File{
+		Name:     "mock_queries.cr",
+		Contents: buf.Bytes(),
+	}, nil
+}
+
+// mockArgs renders the NamedTuple a mock records for a call, with one entry
+// per method parameter
+func mockArgs(query crystalQuery) string {
+	if query.ParamsStruct != "" {
+		return "{params: params}"
+	}
+	if len(query.Params) == 0 {
+		return "NamedTuple.new"
+	}
+
+	parts := make([]string, len(query.Params))
+	for i, p := range paramsByPosition(query.Params) {
+		// A nilable argument holds whichever type was passed, so it is cast
+		// back to the declared union to match mockArgsType
+		if strings.HasSuffix(p.Type, "?") || strings.Contains(p.Type, " | ") {
+			parts[i] = p.Name + ": " + p.Name + ".as(" + p.Type + ")"
+		} else {
+			parts[i] = p.Name + ": " + p.Name
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// mockArgsType is the type of the NamedTuple rendered by mockArgs
+func mockArgsType(query crystalQuery) string {
+	if query.ParamsStruct != "" {
+		return "NamedTuple(params: " + query.ParamsStruct + ")"
+	}
+
+	parts := make([]string, len(query.Params))
+	for i, p := range paramsByPosition(query.Params) {
+		parts[i] = p.Name + ": " + p.Type
+	}
+	return "NamedTuple(" + strings.Join(parts, ", ") + ")"
+}
+
+// mockArgsUnion is the union of the argument types of every query, which
+// recorded calls are stored as
+func mockArgsUnion(queries []crystalQuery) string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, q := range queries {
+		t := mockArgsType(q)
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	return strings.Join(types, " | ")
+}
+
+// mockDefault is what a mocked query returns when nothing was stubbed
+func mockDefault(query crystalQuery) string {
+	switch query.Cmd {
+	case ":one", ":exec":
+		return "nil"
+	case ":many":
+		return query.ReturnType + ".new"
+	case ":execresult":
+		return "DB::ExecResult.new(0_i64, 0_i64)"
+	default:
+		return "0_i64"
+	}
+}
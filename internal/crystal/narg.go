@@ -0,0 +1,114 @@
+package crystal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sqlc-dev/plugin-sdk-go/plugin"
+)
+
+// unsetType is the sentinel type generated for sqlc.narg parameters that
+// can be left out of a PATCH-style update
+const unsetType = "Unset"
+
+var coalesceCall = regexp.MustCompile(`(?i)\bcoalesce\s*\(`)
+
+// applyUnsetNargs turns nullable sqlc.narg parameters used as
+// COALESCE(sqlc.narg(x), col) into tri-state parameters. The COALESCE is
+// rewritten to a CASE on an extra boolean placeholder, so an Unset argument
+// keeps the column value while nil explicitly sets it to NULL.
+func (g *Generator) applyUnsetNargs(query *plugin.Query, cq *crystalQuery) {
+	if !g.options.EmitUnsetNargs || g.req.Settings.Engine != "postgresql" {
+		return
+	}
+
+	// The "is set" flags are appended after the query's own placeholders
+	next := 1
+	for _, param := range query.Params {
+		if int(param.Number) >= next {
+			next = int(param.Number) + 1
+		}
+	}
+
+	for i, param := range query.Params {
+		col := param.Column
+		if col == nil || !col.IsNamedParam || col.NotNull || col.IsSqlcSlice {
+			continue
+		}
+
+		sql, ok := rewriteCoalesce(cq.SQL, int(param.Number), next)
+		if !ok {
+			continue
+		}
+
+		cq.SQL = sql
+		cq.Params[i].Type += " | " + unsetType
+		cq.Params[i].UnsetFlag = next
+		cq.UsesUnset = true
+		next++
+	}
+}
+
+// rewriteCoalesce replaces every COALESCE($number, expr) in sql with
+// CASE WHEN $flag::boolean THEN $number ELSE expr END. It reports whether
+// anything was rewritten.
+func rewriteCoalesce(sql string, number, flag int) (string, bool) {
+	placeholder := regexp.MustCompile(fmt.Sprintf(`^\$%d(::.+)?$`, number))
+
+	var out strings.Builder
+	rewritten := false
+	rest := sql
+
+	for {
+		loc := coalesceCall.FindStringIndex(rest)
+		if loc == nil {
+			break
+		}
+
+		args, end := splitCallArgs(rest, loc[1])
+		if end < 0 || len(args) != 2 || !placeholder.MatchString(args[0]) {
+			out.WriteString(rest[:loc[1]])
+			rest = rest[loc[1]:]
+			continue
+		}
+
+		out.WriteString(rest[:loc[0]])
+		fmt.Fprintf(&out, "CASE WHEN $%d::boolean THEN %s ELSE %s END", flag, args[0], args[1])
+		rest = rest[end+1:]
+		rewritten = true
+	}
+
+	out.WriteString(rest)
+	return out.String(), rewritten
+}
+
+// splitCallArgs splits the top-level, comma separated arguments of a call
+// whose opening parenthesis ends at start. It returns the trimmed arguments
+// and the index of the closing parenthesis, or -1 if it is unbalanced.
+func splitCallArgs(sql string, start int) ([]string, int) {
+	var args []string
+	depth := 0
+	inString := false
+	argStart := start
+
+	for i := start; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == ')':
+			args = append(args, strings.TrimSpace(sql[argStart:i]))
+			return args, i
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(sql[argStart:i]))
+			argStart = i + 1
+		}
+	}
+
+	return nil, -1
+}
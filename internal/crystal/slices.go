@@ -0,0 +1,27 @@
+package crystal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rewritePostgresSlices makes sqlc.slice() parameters work on PostgreSQL,
+// where the whole Crystal Array is sent as a single native array parameter.
+// IN/NOT IN lists around a slice placeholder become = ANY/<> ALL, and any
+// /*SLICE:name*/ markers left in front of the placeholder are dropped.
+func rewritePostgresSlices(sql string, sliceParams []sqlcSliceParam) string {
+	for _, sp := range sliceParams {
+		placeholder := regexp.QuoteMeta(sp.Placeholder) + `\b`
+		marker := `(?:/\*SLICE:` + regexp.QuoteMeta(sp.Marker) + `\*/)?`
+
+		notIn := regexp.MustCompile(`(?i)\bnot\s+in\s*\(\s*` + marker + `(` + placeholder + `)\s*\)`)
+		sql = notIn.ReplaceAllString(sql, "<> ALL($1)")
+
+		in := regexp.MustCompile(`(?i)\bin\s*\(\s*` + marker + `(` + placeholder + `)\s*\)`)
+		sql = in.ReplaceAllString(sql, "= ANY($1)")
+
+		sql = strings.ReplaceAll(sql, fmt.Sprintf("/*SLICE:%s*/", sp.Marker), "")
+	}
+	return sql
+}
@@ -1,16 +1,17 @@
 package crystal
 
 import (
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
-
-	"golang.org/x/text/cases"
-	"golang.org/x/text/language"
 )
 
 var (
 	matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
 	matchAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+	constantName  = regexp.MustCompile(`^[A-Z][A-Za-z0-9_]*$`)
+	methodName    = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
 )
 
 // toSnakeCase converts a string to snake_case
@@ -54,74 +55,12 @@ func toConstantCase(str string) string {
 	return strings.ToUpper(snake)
 }
 
-// singularize attempts to convert a plural word to singular
-// This is a simple implementation for common English pluralization rules
-func singularize(word string) string {
-	if len(word) <= 1 {
-		return word
-	}
-
-	lower := strings.ToLower(word)
-
-	// Handle irregular plurals
-	irregulars := map[string]string{
-		"children": "child",
-		"people":   "person",
-		"men":      "man",
-		"women":    "woman",
-		"feet":     "foot",
-		"teeth":    "tooth",
-		"geese":    "goose",
-		"mice":     "mouse",
-		"dice":     "die",
-	}
-
-	if singular, exists := irregulars[lower]; exists {
-		// Preserve original casing
-		if strings.ToUpper(word) == word {
-			return strings.ToUpper(singular)
-		} else if word[0] >= 'A' && word[0] <= 'Z' {
-			// If the first letter is uppercase, capitalize the singular
-			caser := cases.Title(language.English)
-			return caser.String(singular)
-		}
-		return singular
-	}
-
-	// Handle common suffixes
-	if strings.HasSuffix(lower, "ies") && len(word) > 3 {
-		// companies -> company, cities -> city
-		return word[:len(word)-3] + "y"
-	}
-
-	if strings.HasSuffix(lower, "ves") && len(word) > 3 {
-		// knives -> knife, lives -> life
-		return word[:len(word)-3] + "fe"
-	}
-
-	if strings.HasSuffix(lower, "ses") && len(word) > 3 {
-		// classes -> class, processes -> process
-		return word[:len(word)-2]
-	}
+// defaultInflector holds the built-in singularization rules
+var defaultInflector = NewInflector()
 
-	if strings.HasSuffix(lower, "es") && len(word) > 2 {
-		// Check if it's a simple -es plural (boxes -> box)
-		beforeEs := word[:len(word)-2]
-		lastChar := strings.ToLower(string(beforeEs[len(beforeEs)-1]))
-		if lastChar == "x" || lastChar == "s" || lastChar == "z" ||
-			strings.HasSuffix(strings.ToLower(beforeEs), "ch") ||
-			strings.HasSuffix(strings.ToLower(beforeEs), "sh") {
-			return beforeEs
-		}
-	}
-
-	if strings.HasSuffix(lower, "s") && len(word) > 1 {
-		// Simple plural: books -> book, authors -> author
-		return word[:len(word)-1]
-	}
-
-	// No change needed
-	return word
+// singularize converts a plural word to singular with the default rules
+func singularize(word string) string {
+	return defaultInflector.Singularize(word)
 }
 
 // crystalModuleName converts a module name to proper Crystal module syntax
@@ -148,3 +87,79 @@ func crystalModuleName(name string) string {
 
 	return strings.Join(parts, "::")
 }
+
+// crystalKeywords are reserved words that can't be used as parameter or
+// variable names
+var crystalKeywords = map[string]bool{
+	"abstract": true, "alias": true, "annotation": true, "as": true, "asm": true,
+	"begin": true, "break": true, "case": true, "class": true, "def": true,
+	"do": true, "else": true, "elsif": true, "end": true, "ensure": true,
+	"enum": true, "extend": true, "false": true, "for": true, "fun": true,
+	"if": true, "in": true, "include": true, "instance_sizeof": true, "lib": true,
+	"macro": true, "module": true, "next": true, "nil": true, "of": true,
+	"offsetof": true, "out": true, "pointerof": true, "private": true, "protected": true,
+	"require": true, "rescue": true, "return": true, "select": true, "self": true,
+	"sizeof": true, "struct": true, "super": true, "then": true, "true": true,
+	"type": true, "typeof": true, "uninitialized": true, "union": true, "unless": true,
+	"until": true, "verbatim": true, "when": true, "while": true, "with": true,
+	"yield": true,
+}
+
+// reservedMethods are methods of Object, Struct and the serializable
+// modules that a getter of the same name would override
+var reservedMethods = map[string]bool{
+	"after_initialize": true, "clone": true, "copy_with": true, "crystal_type_id": true, "dup": true,
+	"from_rs": true, "hash": true, "initialize": true, "inspect": true, "itself": true,
+	"object_id": true, "on_unknown_db_column": true, "on_unknown_json_attribute": true,
+	"pretty_print": true, "tap": true, "to_json": true, "to_pretty_json": true,
+	"to_h": true, "to_named_tuple": true, "to_s": true, "to_yaml": true, "try": true,
+	"unsafe_as": true,
+}
+
+// CheckRename checks the keys and names of a rename map. Keys are either
+// a table, renaming its struct to a Crystal constant, or table.column,
+// renaming the column's getter to a method name.
+func CheckRename(rename map[string]string) error {
+	keys := make([]string, 0, len(rename))
+	for key := range rename {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := rename[key]
+		table, column, isColumn := strings.Cut(key, ".")
+		switch {
+		case table == "" || (isColumn && (column == "" || strings.Contains(column, "."))):
+			return fmt.Errorf("%q is not a table or table.column", key)
+		case !isColumn && !constantName.MatchString(name):
+			return fmt.Errorf("%q renames table %s, so it must be a Crystal constant like Author", name, key)
+		case isColumn && (!methodName.MatchString(name) || crystalKeywords[name]):
+			return fmt.Errorf("%q renames column %s, so it must be a lowercase method name that isn't a keyword", name, key)
+		}
+	}
+	return nil
+}
+
+// escapeName renames an identifier that is a Crystal keyword or clashes
+// with a built-in method, using the given ReservedName* strategy. It
+// reports whether the name was changed. The keep strategy only keeps
+// method names, since keywords can't be used as names at all and are
+// suffixed instead.
+func escapeName(name, strategy string) (string, bool) {
+	if !crystalKeywords[name] && !reservedMethods[name] {
+		return name, false
+	}
+
+	switch strategy {
+	case ReservedNameKeep:
+		if !crystalKeywords[name] {
+			return name, false
+		}
+		return name + "_", true
+	case ReservedNamePrefix:
+		return "_" + name, true
+	default:
+		return name + "_", true
+	}
+}
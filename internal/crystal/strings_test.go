@@ -144,3 +144,32 @@ func TestSingularize(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		rename  map[string]string
+		wantErr bool
+	}{
+		{"table", map[string]string{"authors": "Writer"}, false},
+		{"column", map[string]string{"authors.spotify_url": "spotify_link"}, false},
+		{"table and column of the same name", map[string]string{"status": "AccountStatus", "authors.status": "state"}, false},
+		{"table to a method name", map[string]string{"authors": "writer"}, true},
+		{"table to a path", map[string]string{"authors": "Writer::Model"}, true},
+		{"column to a constant", map[string]string{"authors.spotify_url": "SpotifyLink"}, true},
+		{"column to a keyword", map[string]string{"events.ends_at": "end"}, true},
+		{"column to an invalid name", map[string]string{"authors.spotify_url": "spotify-link"}, true},
+		{"missing table", map[string]string{".spotify_url": "spotify_link"}, true},
+		{"missing column", map[string]string{"authors.": "spotify_link"}, true},
+		{"too many parts", map[string]string{"public.authors.spotify_url": "spotify_link"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRename(tt.rename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckRename(%v) error = %v, wantErr %v", tt.rename, err, tt.wantErr)
+			}
+		})
+	}
+}
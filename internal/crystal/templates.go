@@ -8,8 +8,10 @@ import (
 )
 
 var modelsTemplate = template.Must(template.New("models").Funcs(template.FuncMap{
-	"crystalModule": crystalModuleName,
-	"isBooleanType": isBooleanType,
+	"crystalModule":          crystalModuleName,
+	"isBooleanType":          isBooleanType,
+	"modelInitializerParams": modelInitializerParams,
+	"modelFields":            modelFields,
 }).Parse(modelsTemplateStr))
 var queriesTemplate = template.Must(template.New("queries").Funcs(template.FuncMap{
 	"paramNames":          paramNames,
@@ -17,35 +19,81 @@ var queriesTemplate = template.Must(template.New("queries").Funcs(template.FuncM
 	"crystalModule":       crystalModuleName,
 	"join":                strings.Join,
 	"printf":              fmt.Sprintf,
-	"len":                 func(v any) int { return len(v.([]crystalQuery)) },
 	"trimSuffix":          strings.TrimSuffix,
 	"trimPrefix":          strings.TrimPrefix,
 	"joinComments":        joinComments,
 	"expandSliceParams":   expandSliceParams,
 	"needsSliceExpansion": needsSliceExpansion,
 	"contains":            strings.Contains,
+	"rowType":             rowType,
+	"methodParams":        methodParams,
+	"unpackParams":        unpackParams,
+	"paramsByPosition":    paramsByPosition,
+	"initializerParams":   initializerParams,
+	"queryArgs":           queryArgs,
+	"joinParams":          joinParams,
+	"mockArgs":            mockArgs,
+	"mockArgsType":        mockArgsType,
+	"mockArgsUnion":       mockArgsUnion,
+	"mockDefault":         mockDefault,
 }).Parse(queriesTemplateStr))
 
-const modelsTemplateStr = `module {{ .Package | crystalModule }}
+// The mock shares the method signatures defined in the queries template
+var mockQueriesTemplate = template.Must(template.Must(queriesTemplate.Clone()).New("mock").Parse(mockQueriesTemplateStr))
+
+const modelsTemplateStr = `
+{{- range .ModuleDoc }}#{{ if . }} {{ . }}{{ end }}
+{{ end -}}
+module {{ .Package | crystalModule }}
 {{- range .Structs }}
-  struct {{ .Name }}
+  {{- range .Doc }}
+  #{{ if . }} {{ . }}{{ end }}
+  {{- end }}
+  {{ if $.EmitClasses }}class{{ else }}struct{{ end }} {{ .Name }}
     include DB::Serializable
     {{- if $.EmitJSONTags }}
     include JSON::Serializable
     {{- end }}
 
     {{- range .Fields }}
+    {{- range .Doc }}
+    #{{ if . }} {{ . }}{{ end }}
+    {{- end }}
     {{- if and $.EmitJSONTags .JSONName }}
     @[JSON::Field(key: {{ .JSONName | printf "%q" }})]
     {{- end }}
-    {{- if and $.EmitDBTags (ne .DBName .Name) }}
+    {{- if or .Renamed (and $.EmitDBTags (ne .DBName .Name)) }}
     @[DB::Field(key: {{ .DBName | printf "%q" }})]
     {{- end }}
     {{- if and $.EmitBooleanQuestionGetters (isBooleanType .Type) }}
-    getter? {{ .Name }} : {{ .Type }}
+    {{ if $.EmitProperties }}property?{{ else }}getter?{{ end }} {{ .Name }} : {{ .Type }}
     {{- else }}
-    getter {{ .Name }} : {{ .Type }}
+    {{ if $.EmitProperties }}property{{ else }}getter{{ end }} {{ .Name }} : {{ .Type }}
+    {{- end }}
+    {{- end }}
+    {{- if .Fields }}
+
+    def initialize(*, {{ modelInitializerParams .Fields }})
+    end
+    {{- if not $.EmitProperties }}
+
+    def_equals_and_hash {{ modelFields .Fields "@%[1]s" ", " }}
     {{- end }}
+
+    # Returns a copy with the given fields changed
+    def copy_with(*, {{ modelFields .Fields "%[1]s : %[2]s = @%[1]s" ", " }}) : self
+      self.class.new({{ modelFields .Fields "%[1]s: %[1]s" ", " }})
+    end
+
+    # Returns the fields as a Hash keyed by field name
+    def to_h
+      { {{- modelFields .Fields "%[1]q => @%[1]s" ", " -}} }
+    end
+
+    # Returns the fields as a NamedTuple
+    def to_named_tuple
+      { {{- modelFields .Fields "%[1]s: @%[1]s" ", " -}} }
+    end
     {{- end }}
   end
 {{ end -}}
@@ -55,25 +103,216 @@ end
 const queriesTemplateStr = `require "db"
 
 module {{ .Package | crystalModule }}
-  class Queries
-    SQL_{{ .Queries | len | printf "%d_QUERIES" }} = {
+  {{- if and .Header .UsesUnset }}
+  # Default for sqlc.narg parameters that can be left out: passing Unset
+  # keeps the current column value, while nil sets it to NULL.
+  struct Unset
+  end
+{{ end }}
+  {{- range .Queries }}
+  {{- if .ParamsStruct }}
+  # Parameters for {{ $.ClassName }}{{ if $.EmitMethodsWithDBArgument }}.{{ else }}#{{ end }}{{ .Name }}
+  struct {{ .ParamsStruct }}
+    {{- range paramsByPosition .Params }}
+    getter {{ .Name }} : {{ .Type }}
+    {{- end }}
+
+    def initialize(*, {{ paramsByPosition .Params | initializerParams }})
+    end
+  end
+{{ end }}
+  {{- end }}
+  {{- if and .Header .EmitPreparedQueries }}
+  # Prepares each statement once and reuses it for every call. Statements
+  # for fixed SQL are prepared up front by Queries; expanded sqlc.slice()
+  # SQL is prepared the first time each shape is used.
+  class PreparedStatements
+    include DB::QueryMethods(DB::PoolStatement | DB::Statement)
+
+    # Most statements kept prepared. Past it the least recently used one is
+    # closed, so every new sqlc.slice() size can't keep another statement.
+    LIMIT = 256
+
+    # Statements by SQL, ordered from least to most recently used. They are
+    # shared by every fiber, so access is synchronized.
+    @statements = {} of String => DB::PoolStatement | DB::Statement
+    @lock = Mutex.new
+
+    def initialize(@db : DB::Database | DB::Connection)
+    end
+
+    def build(query) : DB::PoolStatement | DB::Statement
+      @lock.synchronize do
+        if statement = @statements.delete(query)
+          return @statements[query] = statement
+        end
+        if @statements.size >= LIMIT
+          _, evicted = @statements.shift
+          evicted.close
+        end
+        @statements[query] = @db.prepared(query)
+      end
+    end
+
+    def close : Nil
+      @lock.synchronize do
+        @statements.each_value(&.close)
+        @statements.clear
+      end
+    end
+  end
+{{ end }}
+  {{- if and .Header .EmitInterface }}
+  # Every query method, so code can depend on this instead of Queries
+  abstract class Querier
+    {{- range .AllQueries }}
+    abstract def {{ template "signature" . }}
+    {{- if eq .Cmd ":many" }}
+    abstract def {{ template "eachSignature" . }}
+    {{- end }}
+    {{- if .CursorBatchSize }}
+    abstract def {{ template "batchSignature" . }}
+    {{- end }}
+    {{- end }}
+    abstract def with_tx(tx : DB::Transaction) : Querier
+  end
+{{ end }}
+  {{- if .ClassName }}
+  {{- if .Reopen }}
+  {{ if .EmitMethodsWithDBArgument }}module{{ else }}class{{ end }} {{ .ClassName }}
+  {{- else if .EmitInterface }}
+  class {{ .ClassName }} < Querier
+  {{- else if .EmitMethodsWithDBArgument }}
+  module {{ .ClassName }}
+    extend self
+{{ else }}
+  class {{ .ClassName }}
+  {{- end }}
+  {{- if .Queries }}
+    {{ .SQLConstant }} = {
       {{- range .Queries }}
       {{ .ConstantName }}: {{ .SQL | printf "%q" }},
       {{- end }}
     }
+  {{- end }}
+  {{- if .Setup }}
+  {{- if .Queries }}
+{{ end }}
+  {{- if .EmitMethodsWithDBArgument }}
+    # Anything a query method can run on
+    alias Executor = DB::Database | DB::Connection | DB::Transaction
+{{ end }}
+  {{- if .Header }}
+    # Transactions run on their connection, so queries always go through a
+    # database or a single connection
+  {{- end }}
+  {{- if .EmitMethodsWithDBArgument }}
+    private def executor(db : Executor) : DB::Database | DB::Connection
+      db.is_a?(DB::Transaction) ? db.connection : db
+    end
+    {{- else }}
+    @db : DB::Database | DB::Connection
+
+    # The transaction these queries run in, if any
+    @tx : DB::Transaction?
+
+    {{- if .EmitPreparedQueries }}
+
+    # Statements prepared on the connections of transactions, reused by
+    # every later transaction on the same connection
+    @tx_statements : Hash(DB::Connection, PreparedStatements)
+
+    def initialize(db : DB::Database | DB::Connection | DB::Transaction)
+      @db = db.is_a?(DB::Transaction) ? db.connection : db
+      @tx = db.as?(DB::Transaction)
+      @statements = PreparedStatements.new(@db)
+      @tx_statements = {} of DB::Connection => PreparedStatements
+      {{- range .AllQueries }}
+      {{- if not (needsSliceExpansion . $.Engine) }}
+      @statements.build({{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}])
+      {{- end }}
+      {{- end }}
+    end
+
+    # Used by with_tx to share statements that are already prepared
+    def initialize(tx : DB::Transaction, @statements : PreparedStatements, @tx_statements : Hash(DB::Connection, PreparedStatements))
+      @db = tx.connection
+      @tx = tx
+    end
+
+    # Closes every statement prepared by these queries and by the
+    # transactions they were bound to
+    def close : Nil
+      @statements.close
+      @tx_statements.each_value(&.close)
+      @tx_statements.clear
+    end
+
+    # Returns queries that run inside the given transaction. Statements are
+    # prepared once per connection, not once per transaction.
+    def with_tx(tx : DB::Transaction) : {{ if .EmitInterface }}Querier{{ else }}{{ .ClassName }}{{ end }}
+      conn = tx.connection
+      statements = conn.same?(@db) ? @statements : (@tx_statements[conn] ||= PreparedStatements.new(conn))
+      {{ .ClassName }}.new(tx, statements, @tx_statements)
+    end
+    {{- else }}
+
+    def initialize(db : DB::Database | DB::Connection | DB::Transaction)
+      @db = db.is_a?(DB::Transaction) ? db.connection : db
+      @tx = db.as?(DB::Transaction)
+    end
 
-    def initialize(@db : DB::Database)
+    # Returns queries that run inside the given transaction
+    def with_tx(tx : DB::Transaction) : {{ if .EmitInterface }}Querier{{ else }}{{ .ClassName }}{{ end }}
+      {{ .ClassName }}.new(tx)
     end
+    {{- end }}
+    {{- end }}
+    {{- if .UsesSliceExpansion }}
+
+    # Most statements kept in the expanded SQL cache
+    EXPANDED_SQL_LIMIT = 256
+
+    # Expanded SQL for sqlc.slice() queries, keyed by query and slice sizes
+    # and ordered from least to most recently used. It is shared by every
+    # fiber, so access is synchronized.
+    @@expanded_sql = {} of String => String
+    @@expanded_sql_lock = Mutex.new
+
+    # Returns the SQL cached under key, expanding it with the block on a
+    # miss. A full cache drops its least recently used statement.
+    private def expanded_sql(key : String, & : -> String) : String
+      @@expanded_sql_lock.synchronize do
+        if sql = @@expanded_sql.delete(key)
+          return @@expanded_sql[key] = sql
+        end
+        @@expanded_sql.shift if @@expanded_sql.size >= EXPANDED_SQL_LIMIT
+        @@expanded_sql[key] = yield
+      end
+    end
+    {{- end }}
+    {{- if and .UsesSliceExpansion .BucketSliceSizes }}
 
+    # Pads a slice argument up to the next power of two by repeating its last
+    # element, so only a few distinct statements are ever prepared
+    private def pad_slice(values : Array(T)) : Array(T) forall T
+      return values if values.empty?
+      values + Array.new(Math.pw2ceil(values.size) - values.size, values.last)
+    end
+    {{- end }}
+  {{- end }}
     {{- range .Queries }}
     {{- if .Comments }}
 
     # {{ .Comments | joinComments }}
     {{- end }}
-    def {{ .Name }}({{ .Params | paramList }}) : {{ .ReturnType }}
+    def {{ template "signature" . }}
+      {{- if .ParamsStruct }}
+      {{ unpackParams .Params }}
+      {{- end }}
       {{- if needsSliceExpansion . $.Engine }}
-      sql = SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]
-      {{ expandSliceParams .Params .SliceParams }}
+      sql = {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]
+      {{ expandSliceParams . $.Engine $.EmptySlices $.BucketSliceSizes false }}
 
       # Flatten array parameters for execution
       query_params = [] of DB::Any
@@ -87,18 +326,18 @@ module {{ .Package | crystalModule }}
 
       {{- if eq .Cmd ":one" }}
       {{- if .ResultStruct }}
-      @db.query_one?(sql, args: query_params, as: {{ .ResultStruct }})
+      {{ $.Executor }}.query_one?(sql, args: query_params, as: {{ .ResultStruct }})
       {{- else }}
-      @db.query_one?(sql, args: query_params) do |rs|
+      {{ $.Executor }}.query_one?(sql, args: query_params) do |rs|
         rs.read({{ .SingleColumnType }})
       end
       {{- end }}
       {{- else if eq .Cmd ":many" }}
       {{- if .ResultStruct }}
-      @db.query_all(sql, args: query_params, as: {{ .ResultStruct }})
+      {{ $.Executor }}.query_all(sql, args: query_params, as: {{ .ResultStruct }})
       {{- else }}
       results = [] of {{ .SingleColumnType }}
-      @db.query(sql, args: query_params) do |rs|
+      {{ $.Executor }}.query(sql, args: query_params) do |rs|
         rs.each do
           results << rs.read({{ .SingleColumnType }})
         end
@@ -106,23 +345,23 @@ module {{ .Package | crystalModule }}
       results
       {{- end }}
       {{- else if eq .Cmd ":exec" }}
-      @db.exec(sql, args: query_params)
+      {{ $.Executor }}.exec(sql, args: query_params)
       nil
       {{- else if eq .Cmd ":execrows" }}
-      result = @db.exec(sql, args: query_params)
+      result = {{ $.Executor }}.exec(sql, args: query_params)
       result.rows_affected
       {{- end }}
       {{- else if eq .Cmd ":one" }}
       {{- if .ResultStruct }}
-      @db.query_one?(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}],{{ if .Params }}
-        {{ .Params | paramNames }},{{ end }}
+      {{ $.Executor }}.query_one?(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}],{{ if .Params }}
+        {{ .Params | queryArgs }},{{ end }}
         as: {{ .ResultStruct }}
       )
       {{- else }}
-      result = @db.query_one?(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
-        {{ .Params | paramNames }}{{ end }}
+      result = {{ $.Executor }}.query_one?(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
       ) do |rs|
         rs.read({{ .SingleColumnType }})
       end
@@ -130,16 +369,16 @@ module {{ .Package | crystalModule }}
       {{- end }}
       {{- else if eq .Cmd ":many" }}
       {{- if .ResultStruct }}
-      @db.query_all(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}],{{ if .Params }}
-        {{ .Params | paramNames }},{{ end }}
+      {{ $.Executor }}.query_all(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}],{{ if .Params }}
+        {{ .Params | queryArgs }},{{ end }}
         as: {{ .ResultStruct }}
       )
       {{- else }}
       results = [] of {{ .SingleColumnType }}
-      @db.query(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
-        {{ .Params | paramNames }}{{ end }}
+      {{ $.Executor }}.query(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
       ) do |rs|
         rs.each do
           results << rs.read({{ .SingleColumnType }})
@@ -148,26 +387,26 @@ module {{ .Package | crystalModule }}
       results
       {{- end }}
       {{- else if eq .Cmd ":exec" }}
-      @db.exec(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
-        {{ .Params | paramNames }}{{ end }}
+      {{ $.Executor }}.exec(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
       )
       nil
       {{- else if eq .Cmd ":execresult" }}
-      @db.exec(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
-        {{ .Params | paramNames }}{{ end }}
+      {{ $.Executor }}.exec(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
       )
       {{- else if eq .Cmd ":execrows" }}
-      result = @db.exec(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
-        {{ .Params | paramNames }}{{ end }}
+      result = {{ $.Executor }}.exec(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
       )
       result.rows_affected
       {{- else if eq .Cmd ":execlastid" }}
-      result = @db.exec(
-        SQL_{{ len $.Queries | printf "%d_QUERIES" }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
-        {{ .Params | paramNames }}{{ end }}
+      result = {{ $.Executor }}.exec(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
       )
       result.last_insert_id
       {{- else if eq .Cmd ":copyfrom" }}
@@ -178,8 +417,187 @@ module {{ .Package | crystalModule }}
       0_i64
       {{- end }}
     end
+    {{- if eq .Cmd ":many" }}
+
+    # Streaming variant of {{ .Name }}: yields each row as it is read
+    # instead of collecting the whole result set into an Array.
+    def {{ template "eachSignature" . }}
+      {{- if .ParamsStruct }}
+      {{ unpackParams .Params }}
+      {{- end }}
+      {{- if needsSliceExpansion . $.Engine }}
+      sql = {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]
+      {{ expandSliceParams . $.Engine $.EmptySlices $.BucketSliceSizes true }}
+
+      # Flatten array parameters for execution
+      query_params = [] of DB::Any
+      {{- range .Params }}
+      {{- if contains .Type "Array(" }}
+      query_params.concat({{ .Name }}.map { |v| v.as(DB::Any) })
+      {{- else }}
+      query_params << {{ .Name }}.as(DB::Any)
+      {{- end }}
+      {{- end }}
+
+      {{ $.Executor }}.query_each(sql, args: query_params) do |rs|
+        yield rs.read({{ rowType . }})
+      end
+      {{- else }}
+      {{ $.Executor }}.query_each(
+        {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+        {{ .Params | queryArgs }}{{ end }}
+      ) do |rs|
+        yield rs.read({{ rowType . }})
+      end
+      {{- end }}
+    end
+    {{- end }}
+    {{- if .CursorBatchSize }}
+
+    # Batched variant of {{ .Name }}: declares a server-side cursor inside a
+    # transaction and yields up to batch_size rows per FETCH. Inside an
+    # existing transaction the cursor lives in a savepoint.
+    def {{ template "batchSignature" . }}
+      {{- if .ParamsStruct }}
+      {{ unpackParams .Params }}
+      {{- end }}
+      {{ if .DBParam }}db{{ else }}(@tx || @db){{ end }}.transaction do |tx|
+        conn = tx.connection
+        conn.exec(
+          "DECLARE {{ .Name }}_cursor NO SCROLL CURSOR FOR " + {{ .SQLConstant }}[{{ .ConstantName | printf ":%s" }}]{{ if .Params }},
+          {{ .Params | queryArgs }}{{ end }}
+        )
+        loop do
+          batch = conn.query_all("FETCH FORWARD #{batch_size} FROM {{ .Name }}_cursor", as: {{ rowType . }})
+          break if batch.empty?
+          yield batch
+        end
+        conn.exec("CLOSE {{ .Name }}_cursor")
+      end
+    end
+    {{- end }}
     {{- end }}
   end
+  {{- end }}
+{{- if .ClassName }}
+{{ end }}end
+{{- define "signature" }}{{ .Name }}({{ joinParams .DBParam (methodParams .Params .ParamsStruct .KeywordParams) }}) : {{ .ReturnType }}{{ end }}
+{{- define "eachSignature" }}each_{{ .Name }}({{ joinParams .DBParam (methodParams .Params .ParamsStruct .KeywordParams) (printf "& : %s ->" (rowType .)) }}) : Nil{{ end }}
+{{- define "batchSignature" }}each_batch_{{ .Name }}({{ joinParams .DBParam (methodParams .Params .ParamsStruct .KeywordParams) (printf "batch_size : Int32 = %d" .CursorBatchSize) (printf "& : Array(%s) ->" (rowType .)) }}) : Nil{{ end }}
+`
+
+const mockQueriesTemplateStr = `
+{{- range .Requires }}require "{{ . }}"{{ end }}
+
+module {{ .Package | crystalModule }}
+  # In-memory Querier for specs. Every call is recorded with its arguments,
+  # and each method returns the value stubbed for it, or an empty result.
+  class MockQueries < Querier
+    alias Args = {{ mockArgsUnion .Queries }}
+
+    # A recorded call to a query method
+    record Call, name : Symbol, args : Args
+
+    # Every call made, in order
+    getter calls = [] of Call
+    {{- range .Queries }}
+    @{{ .Name }}_stub : Proc({{ mockArgsType . }}, {{ .ReturnType }})?
+    {{- end }}
+    {{- range .Queries }}
+
+    # Stubs {{ .Name }} to always return value
+    def stub_{{ .Name }}(value : {{ .ReturnType }}) : Nil
+      @{{ .Name }}_stub = ->(_args : {{ mockArgsType . }}) { value }
+    end
+
+    # Stubs {{ .Name }} with a block computing the result from the arguments
+    def stub_{{ .Name }}(&block : {{ mockArgsType . }} -> {{ .ReturnType }}) : Nil
+      @{{ .Name }}_stub = block
+    end
+
+    def {{ template "signature" . }}
+      {{ .Name }}_result(:{{ .Name }}, {{ mockArgs . }})
+    end
+    {{- if eq .Cmd ":many" }}
+
+    def {{ template "eachSignature" . }}
+      {{ .Name }}_result(:each_{{ .Name }}, {{ mockArgs . }}).each { |row| yield row }
+    end
+    {{- end }}
+    {{- if .CursorBatchSize }}
+
+    def {{ template "batchSignature" . }}
+      {{ .Name }}_result(:each_batch_{{ .Name }}, {{ mockArgs . }}).each_slice(batch_size) { |batch| yield batch }
+    end
+    {{- end }}
+
+    private def {{ .Name }}_result(name : Symbol, args : {{ mockArgsType . }}) : {{ .ReturnType }}
+      @calls << Call.new(name, args)
+      if stub = @{{ .Name }}_stub
+        stub.call(args)
+      else
+        {{ mockDefault . }}
+      end
+    end
+    {{- end }}
+
+    def with_tx(tx : DB::Transaction) : Querier
+      self
+    end
+
+    # Calls made to the given method, in order
+    def calls_to(name : Symbol) : Array(Call)
+      @calls.select { |call| call.name == name }
+    end
+
+    # Forgets all recorded calls, keeping the stubs
+    def reset_calls : Nil
+      @calls.clear
+    end
+
+    # Spec matchers for recorded calls. Include this module in your
+    # spec_helper.cr to use them:
+    #
+    #   mock.should have_called(:get_user)
+    #   mock.should have_called(:get_user, {id: 1_i64}, times: 1)
+    module Expectations
+      def have_called(name : Symbol, args = nil, *, times : Int32? = nil)
+        CalledExpectation.new(name, args, times)
+      end
+    end
+
+    struct CalledExpectation(T)
+      def initialize(@name : Symbol, @args : T, @times : Int32?)
+      end
+
+      def match(mock : MockQueries) : Bool
+        count = matching_calls(mock).size
+        (times = @times) ? count == times : count > 0
+      end
+
+      def failure_message(mock : MockQueries) : String
+        "Expected #{description} to be called, got #{mock.calls_to(@name).map(&.args)}"
+      end
+
+      def negative_failure_message(mock : MockQueries) : String
+        "Expected #{description} not to be called, got #{mock.calls_to(@name).map(&.args)}"
+      end
+
+      private def matching_calls(mock : MockQueries) : Array(Call)
+        calls = mock.calls_to(@name)
+        args = @args
+        args.nil? ? calls : calls.select { |call| call.args == args }
+      end
+
+      private def description : String
+        String.build do |io|
+          io << @name
+          io << " with " << @args unless @args.nil?
+          io << " " << @times << " time(s)" if @times
+        end
+      end
+    end
+  end
 end
 `
 
@@ -211,9 +629,9 @@ func paramList(params []crystalParam) string {
 
 	parts := make([]string, len(params))
 	for i, p := range params {
-		// Add default nil value for nullable parameters
-		if strings.HasSuffix(p.Type, "?") {
-			parts[i] = p.Name + " : " + p.Type + " = nil"
+		// Add default value for nullable and Unset parameters
+		if def := paramDefault(p); def != "" {
+			parts[i] = p.Name + " : " + p.Type + " = " + def
 		} else {
 			parts[i] = p.Name + " : " + p.Type
 		}
@@ -221,6 +639,125 @@ func paramList(params []crystalParam) string {
 	return strings.Join(parts, ", ")
 }
 
+// paramDefault returns the default value of a parameter, or "" when the
+// caller must always pass it
+func paramDefault(p crystalParam) string {
+	switch {
+	case p.UnsetFlag > 0:
+		return unsetType + ".new"
+	case strings.HasSuffix(p.Type, "?"):
+		return "nil"
+	default:
+		return ""
+	}
+}
+
+// queryArgs renders the arguments passed to the database in SQL placeholder
+// order. Unset nargs are passed as nil, followed by their "is set" flags.
+func queryArgs(params []crystalParam) string {
+	var args, flags []string
+	for _, p := range paramsByPosition(params) {
+		if p.UnsetFlag == 0 {
+			args = append(args, p.Name)
+			continue
+		}
+		args = append(args, fmt.Sprintf("(%s.is_a?(%s) ? nil : %s)", p.Name, unsetType, p.Name))
+		flags = append(flags, fmt.Sprintf("!%s.is_a?(%s)", p.Name, unsetType))
+	}
+	return strings.Join(append(args, flags...), ", ")
+}
+
+// paramsByPosition returns a copy of params in SQL placeholder order
+func paramsByPosition(params []crystalParam) []crystalParam {
+	sorted := make([]crystalParam, len(params))
+	copy(sorted, params)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Position < sorted[j].Position
+	})
+	return sorted
+}
+
+// methodParams renders a method's parameter list, which is a single params
+// struct argument when the query exceeds the parameter limit and keyword-only
+// parameters when keyword is set
+func methodParams(params []crystalParam, paramsStruct string, keyword bool) string {
+	if paramsStruct != "" {
+		return "params : " + paramsStruct
+	}
+	if keyword && len(params) > 0 {
+		return "*, " + paramList(params)
+	}
+	return paramList(params)
+}
+
+// joinParams joins the non-empty parts of a parameter list
+func joinParams(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, ", ")
+}
+
+// callArgs renders the arguments used to forward a call to a query method.
+// They are passed by name, which matches both keyword-only and positional
+// parameters whatever order the method declares them in.
+func callArgs(params []crystalParam, paramsStruct string) string {
+	if paramsStruct != "" {
+		return "params"
+	}
+	parts := make([]string, len(params))
+	for i, p := range paramsByPosition(params) {
+		parts[i] = p.Name + ": " + p.Name
+	}
+	return strings.Join(parts, ", ")
+}
+
+// unpackParams binds each params struct field to a local of the same name,
+// so method bodies can refer to parameters the same way in both modes
+func unpackParams(params []crystalParam) string {
+	lines := make([]string, len(params))
+	for i, p := range paramsByPosition(params) {
+		lines[i] = p.Name + " = params." + p.Name
+	}
+	return strings.Join(lines, "\n      ")
+}
+
+// initializerParams renders keyword initializer arguments that assign
+// straight to instance variables
+func initializerParams(params []crystalParam) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = "@" + p.Name + " : " + p.Type
+		if def := paramDefault(p); def != "" {
+			parts[i] += " = " + def
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// modelInitializerParams renders the keyword initializer arguments of a
+// model, with nilable fields defaulting to nil
+func modelInitializerParams(fields []crystalField) string {
+	params := make([]crystalParam, len(fields))
+	for i, f := range fields {
+		params[i] = crystalParam{Name: f.Name, Type: f.Type}
+	}
+	return initializerParams(params)
+}
+
+// modelFields formats each field of a model with format, which gets the
+// field name and type as arguments, and joins the results with sep
+func modelFields(fields []crystalField, format, sep string) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = fmt.Sprintf(format, f.Name, f.Type)
+	}
+	return strings.Join(parts, sep)
+}
+
 func joinComments(comments []string) string {
 	if len(comments) == 0 {
 		return ""
@@ -228,36 +765,94 @@ func joinComments(comments []string) string {
 	return strings.Join(comments, "\n    # ")
 }
 
+// rowType returns the Crystal type of a single row produced by a query,
+// i.e. the result struct or the bare single-column type.
+func rowType(query crystalQuery) string {
+	if query.ResultStruct != "" {
+		return query.ResultStruct
+	}
+	return query.SingleColumnType
+}
+
 func needsSliceExpansion(query crystalQuery, engine string) bool {
 	return query.UsesSQLCSlice && (engine == "mysql" || engine == "sqlite")
 }
 
-func expandSliceParams(params []crystalParam, sliceParams []sqlcSliceParam) string {
-	if len(sliceParams) == 0 {
+func expandSliceParams(query crystalQuery, engine string, emptySlices string, buckets bool, streaming bool) string {
+	if len(query.SliceParams) == 0 {
 		return ""
 	}
 
-	var expansions []string
-	for _, sp := range sliceParams {
-		// Find the corresponding parameter
-		for _, p := range params {
-			if p.Name == sp.Name {
-				// Replace the /*SLICE:name*/? marker with proper question marks
-				expansions = append(expansions, fmt.Sprintf(`
-      # Expand array parameter %s for MySQL/SQLite
+	var guards, pads, keys, gsubs []string
+	for _, sp := range query.SliceParams {
+		name := sp.Name
+		placeholders := fmt.Sprintf(`%s.size.times.map { "?" }.join(", ")`, name)
+
+		if emptySlices == EmptySlicesFalsePredicate {
+			// An empty subquery keeps both IN and NOT IN correct
+			placeholders = fmt.Sprintf("%s.empty? ? %q : %s", name, emptySubquery(engine), placeholders)
+		} else {
+			guards = append(guards, fmt.Sprintf(`
       if %s.empty?
-        raise ArgumentError.new("slice parameter '%s' cannot be empty")
-      end
-      placeholders_%s = %s.size.times.map { "?" }.join(", ")
-      sql = sql.gsub("/*SLICE:%s*/?", placeholders_%s)`,
-					p.Name, p.Name, p.Name, p.Name, p.Name,
-					p.Name, p.Name))
-				break
-			}
+        %s
+      end`, name, emptySliceGuard(query, name, emptySlices, streaming)))
 		}
+
+		if buckets {
+			pads = append(pads, fmt.Sprintf(`
+      %s = pad_slice(%s)`, name, name))
+		}
+
+		keys = append(keys, fmt.Sprintf("#{%s.size}", name))
+
+		// Replace the /*SLICE:name*/? marker with proper question marks
+		gsubs = append(gsubs, fmt.Sprintf(`
+        expanded = expanded.gsub(%q, %s)`, "/*SLICE:"+sp.Marker+"*/?", placeholders))
+	}
+
+	// Each shape of the query is expanded once and reused. Bucketed sizes
+	// are padded first, so they share the keys of their bucket.
+	return `
+      # Expand array parameters for MySQL/SQLite` +
+		strings.Join(guards, "") +
+		strings.Join(pads, "") +
+		fmt.Sprintf(`
+      sql = expanded_sql("%s:%s") do
+        expanded = sql`, query.ConstantName, strings.Join(keys, ",")) +
+		strings.Join(gsubs, "") + `
+        expanded
+      end`
+}
+
+// emptySliceGuard returns the statement run when a slice argument is empty:
+// either raising, or returning the query's empty result without touching
+// the database
+func emptySliceGuard(query crystalQuery, name string, emptySlices string, streaming bool) string {
+	if emptySlices != EmptySlicesShortCircuit {
+		return fmt.Sprintf(`raise ArgumentError.new("slice parameter '%s' cannot be empty")`, name)
 	}
 
-	return strings.Join(expansions, "\n")
+	switch {
+	case streaming:
+		return "return"
+	case query.Cmd == ":one", query.Cmd == ":exec":
+		return "return nil"
+	case query.Cmd == ":many":
+		return fmt.Sprintf("return [] of %s", rowType(query))
+	case query.Cmd == ":execrows":
+		return "return 0_i64"
+	default:
+		return fmt.Sprintf(`raise ArgumentError.new("slice parameter '%s' cannot be empty")`, name)
+	}
+}
+
+// emptySubquery returns a subquery with no rows, which stands in for an
+// empty IN list
+func emptySubquery(engine string) string {
+	if engine == "mysql" {
+		return "SELECT NULL FROM DUAL WHERE 1 = 0"
+	}
+	return "SELECT NULL WHERE 1 = 0"
 }
 
 // isBooleanType checks if a Crystal type is Bool or Bool?
@@ -268,8 +863,9 @@ func isBooleanType(crystalType string) bool {
 // Connection Manager template
 const databaseTemplate = `# Main entry point for generated database code
 # Always require models and queries
-require "./models"
-require "./queries"
+{{- range .Requires }}
+require "{{ . }}"
+{{- end }}
 
 {{- if .GenerateRepositories }}
 # Require all repository files
@@ -280,19 +876,41 @@ require "./repositories/*"
 module {{ .Package | crystalModule }}
   class Database
     @@instance : DB::Database?
-    @@queries : Queries?
+    {{- if .QueriesInstance }}
+    @@queries : {{ .QueriesType }}?
+    {{- end }}
 
     def self.connection
       @@instance ||= DB.open(ENV["DATABASE_URL"])
     end
+    {{- if not .QueriesInstance }}
+
+    def self.transaction(&block)
+      connection.transaction do |tx|
+        yield tx
+      end
+    end
+
+    def self.close
+      @@instance.try(&.close)
+      @@instance = nil
+    end
+  end
+  {{- else }}
 
     def self.queries
       @@queries ||= Queries.new(connection)
     end
+    {{- if .EmitInterface }}
+
+    # Replaces the queries used by repositories, e.g. with a test double
+    def self.queries=(@@queries : Querier?)
+    end
+    {{- end }}
 
     def self.transaction(&block)
       connection.transaction do |tx|
-        yield Queries.new(tx.connection)
+        yield queries.with_tx(tx)
       end
     end
 
@@ -305,13 +923,14 @@ module {{ .Package | crystalModule }}
 
   # Transaction context for repositories
   class TransactionContext
-    def initialize(@queries : Queries)
+    def initialize(@queries : {{ .QueriesType }})
     end
 
-    def queries : Queries
+    def queries : {{ .QueriesType }}
       @queries
     end
   end
+  {{- end }}
 end
 {{- end }}
 `
@@ -323,21 +942,34 @@ const repositoryTemplate = `module {{ .Package | crystalModule }}
     {{- range .Methods }}
     {{- if .IsTableSpecific }}
 
-    def {{ .MethodName }}({{ .Params | paramList }}){{ if .ReturnType }} : {{ .ReturnType }}{{ end }}
-      Database.queries.{{ .Name }}({{ .Params | paramNames }})
+    def {{ .MethodName }}({{ methodParams .Params .ParamsStruct .KeywordParams }}){{ if .ReturnType }} : {{ .ReturnType }}{{ end }}
+      {{- if $.EmitMethodsWithDBArgument }}
+      Queries.{{ .Name }}({{ joinParams "Database.connection" (callArgs .Params .ParamsStruct) }})
+      {{- else }}
+      Database.queries.{{ .Name }}({{ callArgs .Params .ParamsStruct }})
+      {{- end }}
     end
     {{- end }}
     {{- end }}
 
     # Transaction wrapper class
     class Transaction
-      def initialize(@queries : Queries)
+      {{- if .EmitMethodsWithDBArgument }}
+      def initialize(@db : Queries::Executor)
       end
+      {{- else }}
+      def initialize(@queries : {{ .QueriesType }})
+      end
+      {{- end }}
       {{- range .Methods }}
       {{- if .IsTableSpecific }}
 
-      def {{ .MethodName }}({{ .Params | paramList }}){{ if .ReturnType }} : {{ .ReturnType }}{{ end }}
-        @queries.{{ .Name }}({{ .Params | paramNames }})
+      def {{ .MethodName }}({{ methodParams .Params .ParamsStruct .KeywordParams }}){{ if .ReturnType }} : {{ .ReturnType }}{{ end }}
+        {{- if $.EmitMethodsWithDBArgument }}
+        Queries.{{ .Name }}({{ joinParams "@db" (callArgs .Params .ParamsStruct) }})
+        {{- else }}
+        @queries.{{ .Name }}({{ callArgs .Params .ParamsStruct }})
+        {{- end }}
       end
       {{- end }}
       {{- end }}
@@ -345,8 +977,8 @@ const repositoryTemplate = `module {{ .Package | crystalModule }}
 
     # Execute a block within a transaction
     def transaction(&block : Transaction ->)
-      Database.transaction do |tx_queries|
-        yield Transaction.new(tx_queries)
+      Database.transaction do |{{ if .EmitMethodsWithDBArgument }}tx{{ else }}tx_queries{{ end }}|
+        yield Transaction.new({{ if .EmitMethodsWithDBArgument }}tx{{ else }}tx_queries{{ end }})
       end
     end
   end
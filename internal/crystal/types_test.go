@@ -234,10 +234,9 @@ func TestSQLiteTypeMapping(t *testing.T) {
 
 func TestCrystalTypeWithNullability(t *testing.T) {
 	tests := []struct {
-		name        string
-		column      *plugin.Column
-		expected    string
-		withPointer bool
+		name     string
+		column   *plugin.Column
+		expected string
 	}{
 		{
 			name: "not null integer",
@@ -255,15 +254,6 @@ func TestCrystalTypeWithNullability(t *testing.T) {
 			},
 			expected: "Int32?",
 		},
-		{
-			name: "nullable integer with pointer",
-			column: &plugin.Column{
-				Type:    &plugin.Identifier{Name: "int4"},
-				NotNull: false,
-			},
-			expected:    "Int32*",
-			withPointer: true,
-		},
 		{
 			name: "integer array",
 			column: &plugin.Column{
@@ -291,9 +281,6 @@ func TestCrystalTypeWithNullability(t *testing.T) {
 						Engine: "postgresql",
 					},
 				},
-				options: GeneratorOptions{
-					EmitResultStructPointers: tt.withPointer,
-				},
 			}
 
 			result := gen.crystalType(tt.column)